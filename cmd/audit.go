@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+)
+
+var auditUsage = `Compare the values defined with the values the templates read.
+
+Keys defined in a values source but never read by any template are reported
+as unused, with the file and line defining them. Keys read by a template but
+defined by no values source, which render as empty, are reported as
+undefined, with the template, line and column reading them. Keys that are only
+tested, e.g. '{{ if .Values.a }}', or given a default are expected to be
+missing and are not reported. The command exits with a non-zero status if any
+key was reported.
+
+The values read are found by walking the templates, including the named
+templates they include. A value read through something only known at render
+time, e.g. 'index .Values.a $key', counts as reading all of its parent.
+`
+
+func newAuditCmd(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "audit",
+		Short: "report unused and undefined values keys",
+		Long:  auditUsage,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r, err := newRenderer()
+			if err != nil {
+				return err
+			}
+			result, err := r.Audit()
+			if err != nil {
+				return err
+			}
+			problems := len(result.Unused) + len(result.Undefined)
+			if problems == 0 {
+				fmt.Fprintf(out, "%d template(s) audited, no problems found\n", result.Templates)
+				return nil
+			}
+			for _, key := range result.Unused {
+				fmt.Fprintf(out, "[UNUSED] %s\n", key)
+			}
+			for _, key := range result.Undefined {
+				fmt.Fprintf(out, "[UNDEFINED] %s\n", key)
+			}
+			return fmt.Errorf("%d template(s) audited, %d unused and %d undefined key(s) found", result.Templates, len(result.Unused), len(result.Undefined))
+		},
+	}
+}
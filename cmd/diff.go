@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"yaml-template-cli/pkg/fileutil"
+	"yaml-template-cli/pkg/render"
+)
+
+// DiffExitCode is the exit status of the diff command when the rendered
+// output differs from the output directory.
+const DiffExitCode = 2
+
+// DiffError is returned by the diff command when the rendered output differs
+// from the output directory. The command then exits with DiffExitCode.
+type DiffError struct {
+	// Changed is the number of files that differ.
+	Changed int
+}
+
+func (e DiffError) Error() string {
+	return fmt.Sprintf("%d file(s) differ from the output directory", e.Changed)
+}
+
+var diffUsage = `Render the templates exactly like the root command, then show a unified diff
+against the files currently in the output directory, without writing anything.
+
+Files that the render would add or change are reported, and with --clean the
+files that exist only in the output directory, which it would remove. The command exits with status 0 when the output
+directory is up to date, 2 when it differs and 1 on errors, so CI can use it
+to detect drift between committed rendered configs and their templates.
+`
+
+func newDiffCmd(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff",
+		Short: "show the changes a render would make to the output directory",
+		Long:  diffUsage,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if settings.OutputDir == "" {
+				return fmt.Errorf("output dir is not specified")
+			}
+			if settings.outputFormat() != render.OutputDir {
+				return fmt.Errorf("diff only supports the %s output format", render.OutputDir)
+			}
+			// diff writes nothing, not even the cache.
+			settings.Cache = false
+			r, err := newRenderer()
+			if err != nil {
+				return err
+			}
+			result, err := r.Render()
+			if err != nil {
+				return err
+			}
+			files := make(map[string]string, len(result.Files))
+			for _, file := range result.Files {
+				files[filepath.Join(settings.OutputDir, file.Name)] = file.Content
+			}
+			changed, err := diffOutputDir(out, files)
+			if err != nil {
+				return err
+			}
+			if changed > 0 {
+				return DiffError{Changed: changed}
+			}
+			return nil
+		},
+	}
+}
+
+// diffOutputDir writes a unified diff between the current content of the
+// output directory and files, and returns the number of files that differ.
+// The files that are only in the output directory are only reported with
+// --clean, otherwise a render keeps them.
+func diffOutputDir(out io.Writer, files map[string]string) (int, error) {
+	existing, err := fileutil.ListAllFiles(settings.OutputDir)
+	if err != nil {
+		return 0, err
+	}
+	current := make(map[string]string, len(existing))
+	for _, name := range existing {
+		if name == filepath.Join(settings.OutputDir, render.MarkerFile) {
+			continue
+		}
+		data, err := fileutil.ReadFile(name)
+		if err != nil {
+			return 0, err
+		}
+		current[name] = string(data)
+	}
+
+	names := make([]string, 0, len(files)+len(current))
+	for name := range files {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := files[name]; !ok && settings.Clean {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := 0
+	for _, name := range names {
+		oldContent, inOld := current[name]
+		newContent, inNew := files[name]
+		if inOld && inNew && oldContent == newContent {
+			continue
+		}
+		rel, err := filepath.Rel(settings.OutputDir, name)
+		if err != nil {
+			return 0, err
+		}
+		fromFile, toFile := "a/"+filepath.ToSlash(rel), "b/"+filepath.ToSlash(rel)
+		if !inOld {
+			fromFile = "/dev/null"
+		}
+		if !inNew {
+			toFile = "/dev/null"
+		}
+		text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(oldContent),
+			B:        splitLines(newContent),
+			FromFile: fromFile,
+			ToFile:   toFile,
+			Context:  3,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(out, text); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// splitLines splits s into lines that all end with a newline, as expected by
+// difflib.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"sort"
+	"yaml-template-cli/pkg/engine"
+)
+
+var graphUsage = `Print the dependency graph of the templates, without rendering them.
+
+For every template, the graph holds the named templates it executes with
+'include' or 'template', and the data paths it reads, e.g. 'Values.image.tag',
+'.' standing for the whole data. Named templates are linked to the file
+defining them. Templates marked dynamic also depend on something else, e.g.
+the environment, the time or a named template whose name is computed, and are
+never taken from the --cache.
+
+The graph is printed in the DOT language by default, for Graphviz, or as JSON.
+`
+
+func newGraphCmd(out io.Writer) *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "graph",
+		Short: "print the dependency graph of the templates",
+		Long:  graphUsage,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "dot" && format != "json" {
+				return fmt.Errorf("unknown graph format %q, must be dot or json", format)
+			}
+			r, err := newRenderer()
+			if err != nil {
+				return err
+			}
+			graph, err := r.Graph()
+			if err != nil {
+				return err
+			}
+			if format == "json" {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(graph)
+			}
+			writeDOT(out, graph)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "dot", "output format: dot or json")
+	return cmd
+}
+
+// writeDOT prints the graph in the DOT language. Templates files are boxes,
+// named templates ellipses and values paths notes.
+func writeDOT(out io.Writer, graph *engine.Graph) {
+	fmt.Fprintln(out, "digraph templates {")
+	fmt.Fprintln(out, "  rankdir=LR;")
+	values := map[string]bool{}
+	for _, file := range graph.Files {
+		attrs := "shape=box"
+		if file.Dynamic {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(out, "  %q [%s];\n", "file:"+file.Name, attrs+fmt.Sprintf(", label=%q", file.Name))
+		for _, name := range file.Includes {
+			fmt.Fprintf(out, "  %q -> %q;\n", "file:"+file.Name, "define:"+name)
+		}
+		for _, path := range file.Values {
+			if path == "" {
+				path = "."
+			}
+			values[path] = true
+			fmt.Fprintf(out, "  %q -> %q;\n", "file:"+file.Name, "values:"+path)
+		}
+	}
+	files := map[string]bool{}
+	for _, file := range graph.Files {
+		files[file.Name] = true
+	}
+	for _, define := range graph.Defines {
+		if !files[define.File] {
+			// partials and libraries
+			files[define.File] = true
+			fmt.Fprintf(out, "  %q [shape=plaintext, label=%q];\n", "file:"+define.File, define.File)
+		}
+		fmt.Fprintf(out, "  %q [shape=ellipse, label=%q];\n", "define:"+define.Name, define.Name)
+		fmt.Fprintf(out, "  %q -> %q [style=dotted, label=\"defined in\"];\n", "define:"+define.Name, "file:"+define.File)
+		for _, name := range define.Includes {
+			fmt.Fprintf(out, "  %q -> %q;\n", "define:"+define.Name, "define:"+name)
+		}
+	}
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(out, "  %q [shape=note, label=%q];\n", "values:"+path, path)
+	}
+	fmt.Fprintln(out, "}")
+}
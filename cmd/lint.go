@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+)
+
+var lintUsage = `Render every template in lint mode and report all problems.
+
+Missing 'required' values, 'fail' calls, parse errors, execution errors and
+rendered output that is not valid YAML are collected across all templates
+instead of stopping at the first one. The command exits with a non-zero status
+if any problem was found.
+`
+
+func newLintCmd(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "lint",
+		Short: "examine templates for possible issues",
+		Long:  lintUsage,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r, err := newRenderer()
+			if err != nil {
+				return err
+			}
+			result, err := r.Lint()
+			if err != nil {
+				return err
+			}
+			if len(result.Problems) == 0 {
+				fmt.Fprintf(out, "%d template(s) linted, no problems found\n", result.Templates)
+				return nil
+			}
+			for _, problem := range result.Problems {
+				fmt.Fprintf(out, "[ERROR] %s\n", problem)
+			}
+			return fmt.Errorf("%d template(s) linted, %d problem(s) found", result.Templates, len(result.Problems))
+		},
+	}
+}
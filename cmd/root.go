@@ -6,11 +6,12 @@ import (
 	"io"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
-	"yaml-template-cli/pkg/engine"
-	"yaml-template-cli/pkg/fileutil"
+	"strings"
+	"yaml-template-cli/pkg/getter"
+	"yaml-template-cli/pkg/render"
 	"yaml-template-cli/pkg/templates"
+	"yaml-template-cli/pkg/watch"
 )
 
 var globalUsage = `The YAML templates renderer
@@ -24,92 +25,151 @@ func init() {
 
 func NewRootCmd(out io.Writer, args []string) (*cobra.Command, error) {
 	cmd := &cobra.Command{
-		Use:          "yaml-templates-cli",
-		Short:        "The YAML templates renderer",
-		Long:         globalUsage,
-		SilenceUsage: true,
-		Run: func(cmd *cobra.Command, args []string) {
-			err := handler()
-			if err != nil {
-				if _, err := out.Write([]byte(err.Error())); err != nil {
-					return
-				}
+		Use:           "yaml-templates-cli",
+		Short:         "The YAML templates renderer",
+		Long:          globalUsage,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return settings.ParseOverrideValues()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if settings.Watch {
+				return watchHandler()
 			}
+			return handler()
 		},
 	}
 	flags := cmd.PersistentFlags()
 
 	settings.AddFlags(flags)
 
-	flags.ParseErrorsWhitelist.UnknownFlags = true
-	err := flags.Parse(args)
-	if err != nil {
-		return nil, err
-	}
-	os.Args = args[:1] // 这里解析参数，将参数去掉了，避免重复处理
+	cmd.SetOut(out)
+	cmd.SetArgs(args)
 
 	cmd.AddCommand(versionCmd)
-
-	settings.ParseOverrideValues(overrides)
+	cmd.AddCommand(newLintCmd(out))
+	cmd.AddCommand(newDiffCmd(out))
+	cmd.AddCommand(newGraphCmd(out))
+	cmd.AddCommand(newAuditCmd(out))
 
 	return cmd, nil
 }
 
-func handler() error {
+// newRenderer returns a Renderer configured from the settings.
+func newRenderer() (*render.Renderer, error) {
+	opts, err := settings.RenderOptions()
+	if err != nil {
+		return nil, err
+	}
 	if settings.Stdin {
-		in, _ := io.ReadAll(os.Stdin)
-		values, err := fileutil.ReadValuesFiles(settings.ValuesFiles)
-		if err != nil {
-			return err
+		if contains(settings.ValuesFiles, getter.Stdin) {
+			return nil, fmt.Errorf("cannot read both the template and values from stdin")
 		}
-		values.OverrideValues(settings.Overrides)
-		tpl := &templates.Template{
-			Templates: []templates.File{
-				{
-					Name: "stdin",
-					Data: in,
-				},
+		in, _ := io.ReadAll(os.Stdin)
+		opts.Templates = []templates.File{
+			{
+				Name: "stdin",
+				Data: in,
 			},
-			Values: values,
-		}
-		render, err := engine.Render(tpl, tpl.Values)
-		if err != nil {
-			return err
 		}
-		if settings.OutputDir == "" {
-			for k, v := range render {
-				fmt.Printf("# Source: %s\n%s\n---\n", k, v)
-			}
-		}
-		return nil
 	}
-	if settings.InputDir == "" {
-		return fmt.Errorf("input dir is not specified")
+	stream := render.StreamSink{
+		W:              os.Stdout,
+		Separator:      settings.Separator,
+		SourceHeader:   settings.SourceHeader,
+		SplitDocuments: settings.SplitDocuments,
 	}
-	yamlFiles, err := fileutil.ListAllFilesWithExt(settings.InputDir, []string{".yaml", ".yml"})
-	if err != nil {
-		return err
+	format := settings.outputFormat()
+	if format != render.OutputStdout && settings.OutputDir == "" {
+		return nil, fmt.Errorf("output format %s needs an output path (-o)", format)
 	}
-	tpls, err := fileutil.ReadTemplateFiles(yamlFiles, settings.ValuesFiles)
-	if err != nil {
-		return err
+	if settings.Stdin && format == render.OutputDir {
+		return nil, fmt.Errorf("a template read from stdin can't be written to an output directory, use --output-format %s, %s or %s with -o, or print it without -o", render.OutputFile, render.OutputTarGz, render.OutputZip)
 	}
-	tpls.Values.OverrideValues(settings.Overrides)
-	render, err := engine.Render(tpls, tpls.Values)
+	if (settings.Clean || settings.DryRun) && format != render.OutputDir {
+		return nil, fmt.Errorf("--clean and --dry-run only support the %s output format", render.OutputDir)
+	}
+	switch format {
+	case render.OutputStdout:
+		opts.Sink = &stream
+	case render.OutputDir:
+		opts.Sink = &render.DirSink{
+			Dir:    settings.OutputDir,
+			Clean:  settings.Clean,
+			DryRun: settings.DryRun,
+			Out:    os.Stdout,
+			Atomic: settings.Atomic,
+		}
+	case render.OutputTarGz:
+		opts.Sink = &render.TarGzSink{Path: settings.OutputDir}
+	case render.OutputZip:
+		opts.Sink = &render.ZipSink{Path: settings.OutputDir}
+	case render.OutputFile:
+		opts.Sink = &render.FileSink{Path: settings.OutputDir, Stream: stream}
+	default:
+		return nil, fmt.Errorf("unknown output format %q, must be one of %s", settings.OutputFormat, strings.Join(render.OutputFormats, ", "))
+	}
+	return render.New(opts), nil
+}
+
+func handler() error {
+	r, err := newRenderer()
 	if err != nil {
 		return err
 	}
-	if settings.OutputDir == "" {
-		for k, v := range render {
-			fmt.Printf("# Source: %s\n%s\n---\n", k, v)
+	_, err = r.Run()
+	return err
+}
+
+// watchHandler runs handler once, then again every time a template or values
+// file changes. Render errors are printed and the watch goes on.
+func watchHandler() error {
+	if settings.Stdin {
+		return fmt.Errorf("--watch cannot be used with --stdin")
+	}
+	if settings.InputDir == "" {
+		return fmt.Errorf("input dir is not specified")
+	}
+	paths := append([]string{settings.InputDir}, settings.Libs...)
+	for _, source := range settings.ValuesFiles {
+		switch {
+		case getter.IsRemote(source) || source == getter.Stdin:
+			continue
+		case getter.IsGlob(source):
+			// Watch the directory so new files matching the pattern are seen.
+			paths = append(paths, filepath.Dir(source))
+		default:
+			paths = append(paths, source)
 		}
-		return nil
 	}
-	for k, v := range render {
-		err := fileutil.WriteFile(filepath.Join(settings.OutputDir, path.Base(k)), []byte(v), 0644)
-		if err != nil {
-			return err
+	if settings.SchemaFile != "" {
+		paths = append(paths, settings.SchemaFile)
+	}
+	run := func() {
+		if err := handler(); err != nil {
+			log.Printf("%v\n", err)
+			return
 		}
+		log.Printf("rendered %s\n", settings.InputDir)
+	}
+	run()
+	log.Printf("watching %s for changes\n", strings.Join(paths, ", "))
+	// The output and the cache are written by every render, they must not
+	// trigger the next one when they are inside a watched directory.
+	exclude := []string{settings.OutputDir}
+	if settings.Cache {
+		exclude = append(exclude, settings.cacheFile())
 	}
+	watch.New(paths, exclude...).Run(nil, run)
 	return nil
 }
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
@@ -1,48 +1,245 @@
 package cmd
 
 import (
+	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"yaml-template-cli/pkg/fileutil"
+	"yaml-template-cli/pkg/getter"
+	"yaml-template-cli/pkg/render"
+	"yaml-template-cli/pkg/strvals"
 	"yaml-template-cli/pkg/templates"
+	"yaml-template-cli/pkg/yamlutil"
 )
 
 var (
-	overrides []string
+	overrides       []string
+	stringOverrides []string
+	fileOverrides   []string
+	jsonOverrides   []string
 )
 
 type Settings struct {
 	//Flags       *pflag.FlagSet
-	Debug       bool
-	OutputDir   string
+	Debug     bool
+	OutputDir string
+	// OutputFormat selects where the output goes, see render.OutputFormats.
+	// Empty means a directory when OutputDir is set, stdout otherwise.
+	OutputFormat string
+	// Clean removes the files of the output directory the render did not
+	// produce, DryRun only lists them.
+	Clean  bool
+	DryRun bool
+	// Atomic swaps the whole output directory in at once.
+	Atomic bool
+	// FileMode overrides the permissions of the output files, in octal.
+	FileMode    string
 	ValuesFiles []string
-	InputDir    string
-	Stdin       bool
-	Overrides   templates.Values
+	// ValuesFormat forces the format of the values files, which is otherwise
+	// picked from their extension.
+	ValuesFormat string
+	// MergeStrategy and MergeKey select how lists are merged.
+	MergeStrategy string
+	MergeKey      string
+	// ValuesTimeout, ValuesCacheDir and Offline control how remote values
+	// sources are fetched.
+	ValuesTimeout  time.Duration
+	ValuesCacheDir string
+	Offline        bool
+	SchemaFile     string
+	InputDir       string
+	// Include and Exclude select the template files of the input directory.
+	Include []string
+	Exclude []string
+	// Libs are directories of library templates.
+	Libs []string
+	// Matrix renders templates once per element of a values list, see
+	// render.Options.Matrix.
+	Matrix   []string
+	Stdin    bool
+	Strict   bool
+	Validate bool
+	// FlatValues gives the templates the values as the root of their data,
+	// as older versions did, instead of under .Values.
+	FlatValues bool
+	// Jobs is the number of templates rendered in parallel.
+	Jobs int
+	// Cache keeps the outputs between runs in a file next to the output,
+	// see cacheFile.
+	Cache bool
+	Watch bool
+	// AllowEnv is the allow-list of the environment variables templates may
+	// read with 'env' and 'expandenv'.
+	AllowEnv []string
+	// EnvValuesPrefix loads the environment variables with this prefix into
+	// the values.
+	EnvValuesPrefix string
+	// Separator, SourceHeader and SplitDocuments shape the YAML stream
+	// written when no output directory is given.
+	Separator      string
+	SourceHeader   bool
+	SplitDocuments bool
+	Overrides      templates.Values
 }
 
 func New() *Settings {
-	return &Settings{}
+	return &Settings{
+		MergeStrategy: string(templates.MergeReplace),
+		MergeKey:      templates.DefaultListKey,
+		ValuesTimeout: getter.DefaultTimeout,
+		Separator:     yamlutil.DefaultSeparator,
+		SourceHeader:  true,
+		Jobs:          1,
+	}
 }
 
 func (s *Settings) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVarP(&s.OutputDir, "out", "o", s.OutputDir, "output directory")
-	fs.StringSliceVarP(&s.ValuesFiles, "values", "v", []string{}, "values file path")
+	fs.StringVarP(&s.OutputDir, "out", "o", s.OutputDir, "output directory, or output file for the tar.gz, zip and file output formats")
+	fs.StringVar(&s.OutputFormat, "output-format", s.OutputFormat, "output format: "+strings.Join(render.OutputFormats, ", ")+" (default: dir when -o is set, stdout otherwise)")
+	fs.BoolVar(&s.Clean, "clean", s.Clean, "remove the files of the output directory that the render did not produce (only in directories created by this tool)")
+	fs.BoolVar(&s.DryRun, "dry-run", s.DryRun, "write and remove nothing, list the files --clean would remove")
+	fs.BoolVar(&s.Atomic, "atomic", s.Atomic, "write the output to a temporary sibling directory, then swap it with the output directory in one atomic rename, so the output is never partially written and is left untouched on failure (outside Linux the swap takes two renames and the directory is briefly missing between them)")
+	fs.StringSliceVar(&s.Include, "include", s.Include, "patterns of the template files of the input directory, in .gitignore syntax, matched with and without the .tpl or .gotmpl suffix (default \"*.yaml,*.yml\")")
+	fs.StringSliceVar(&s.Exclude, "exclude", s.Exclude, "patterns of the files and directories of the input directory that are not templates, in .gitignore syntax, added to the ones of its "+fileutil.IgnoreFileName+" file")
+	fs.IntVarP(&s.Jobs, "jobs", "j", s.Jobs, "number of templates rendered in parallel")
+	fs.BoolVar(&s.Cache, "cache", s.Cache, "keep the outputs and their dependencies in a cache file next to the output, and only render again the templates whose sources, named templates or values read changed")
+	fs.StringArrayVar(&s.Libs, "lib", s.Libs, "directory of library templates defining named templates for 'include', which are not rendered (can specify multiple)")
+	fs.StringArrayVar(&s.Matrix, "matrix", s.Matrix, "render templates once per element of a values list: [TEMPLATE=]PATH, e.g. 'service.yaml=services', TEMPLATE being a pattern of the templates (default: all templates)")
+	fs.StringVar(&s.FileMode, "file-mode", s.FileMode, "permissions of the output files, in octal, e.g. 0600 (default: the permissions of the template)")
+	fs.StringSliceVarP(&s.ValuesFiles, "values", "v", []string{}, "values file path, glob pattern, '-' for stdin, or file:// or http(s):// URL")
+	fs.StringVar(&s.MergeStrategy, "merge-strategy", s.MergeStrategy, "how lists of the values files and overrides are merged: replace, append-lists or merge-lists-by-key")
+	fs.StringVar(&s.MergeKey, "merge-key", s.MergeKey, "key identifying the list items merged by the merge-lists-by-key strategy")
+	fs.DurationVar(&s.ValuesTimeout, "values-timeout", s.ValuesTimeout, "timeout for fetching a remote values file")
+	fs.StringVar(&s.ValuesCacheDir, "values-cache-dir", s.ValuesCacheDir, "directory keeping a copy of the remote values files, used when they can't be fetched")
+	fs.BoolVar(&s.Offline, "offline", s.Offline, "read remote values files from --values-cache-dir instead of fetching them")
+	fs.StringVar(&s.ValuesFormat, "values-format", s.ValuesFormat, "format of the values files: "+strings.Join(templates.Formats, ", ")+" (default: picked from the file extension)")
 	fs.StringVarP(&s.InputDir, "in", "i", s.InputDir, "input directory")
+	fs.StringVar(&s.SchemaFile, "schema", s.SchemaFile, "JSON Schema file the merged values are validated against (default: values.schema.json in the input directory)")
 	fs.BoolVarP(&s.Stdin, "stdin", "s", s.Stdin, "stdin")
-	fs.StringSliceVarP(&overrides, "set", "", []string{}, "set")
+	fs.BoolVar(&s.Strict, "strict", s.Strict, "fail the render when a template references a value that was not passed in")
+	fs.BoolVar(&s.FlatValues, "flat-values", s.FlatValues, "give the templates the values as the root of their data ('{{ .name }}'), as older versions did, instead of under .Values ('{{ .Values.name }}'), without .Files, .Env and .Render")
+	fs.BoolVar(&s.Validate, "validate", s.Validate, "parse every rendered .yaml, .yml and .json file as YAML and fail before writing any output if one is invalid")
+	fs.BoolVarP(&s.Watch, "watch", "w", s.Watch, "keep running and render again when a template or values file changes")
+	fs.StringSliceVar(&s.AllowEnv, "allow-env", []string{}, "enable the 'env' and 'expandenv' template functions for the environment variables matching these prefixes or glob patterns (all variables if no value is given)")
+	fs.Lookup("allow-env").NoOptDefVal = "*"
+	fs.StringVar(&s.EnvValuesPrefix, "env-values", s.EnvValuesPrefix, "load the environment variables with this prefix into the values, '__' separating nested keys (APP__db__host sets db.host)")
+	fs.StringVar(&s.Separator, "separator", s.Separator, "line written between two documents of the output stream")
+	fs.BoolVar(&s.SourceHeader, "source-header", s.SourceHeader, "add a '# Source: <template>' comment to every document of the output stream")
+	fs.BoolVar(&s.SplitDocuments, "split-documents", s.SplitDocuments, "split the output of a template on '---' into separate documents of the output stream")
+	fs.StringArrayVar(&overrides, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	fs.StringArrayVar(&stringOverrides, "set-string", []string{}, "set STRING values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	fs.StringArrayVar(&fileOverrides, "set-file", []string{}, "set values from respective files specified via the command line (can specify multiple or separate values with commas: key1=path1,key2=path2)")
+	fs.StringArrayVar(&jsonOverrides, "set-json", []string{}, "set JSON values on the command line (can specify multiple or separate values with commas: key1=jsonval1,key2=jsonval2)")
 }
 
-func (s *Settings) ParseOverrideValues(overrides []string) {
-	overridesMap := make(map[string]interface{})
-	for _, override := range overrides {
-		if len(override) == 0 {
-			continue
+// ParseOverrideValues parses the --set-json, --set, --set-string and --set-file
+// flags, in that order, into s.Overrides. Dotted keys become nested maps, so
+// the result can be merged over the values files.
+func (s *Settings) ParseOverrideValues() error {
+	overridesMap := map[string]interface{}{}
+
+	for _, value := range jsonOverrides {
+		if err := strvals.ParseJSON(value, overridesMap); err != nil {
+			return errors.Errorf("failed parsing --set-json data %s", value)
 		}
-		split := strings.SplitN(override, "=", 2)
-		if len(split) != 2 {
-			continue
+	}
+
+	for _, value := range overrides {
+		if err := strvals.ParseInto(value, overridesMap); err != nil {
+			return errors.Wrap(err, "failed parsing --set data")
+		}
+	}
+
+	for _, value := range stringOverrides {
+		if err := strvals.ParseIntoString(value, overridesMap); err != nil {
+			return errors.Wrap(err, "failed parsing --set-string data")
 		}
-		overridesMap[split[0]] = split[1]
 	}
+
+	for _, value := range fileOverrides {
+		reader := func(rs []rune) (interface{}, error) {
+			data, err := fileutil.ReadFile(string(rs))
+			return string(data), err
+		}
+		if err := strvals.ParseIntoFile(value, overridesMap, reader); err != nil {
+			return errors.Wrap(err, "failed parsing --set-file data")
+		}
+	}
+
 	s.Overrides = overridesMap
+	return nil
+}
+
+// outputFormat returns the output format, defaulting on -o.
+func (s *Settings) outputFormat() string {
+	if s.OutputFormat != "" {
+		return s.OutputFormat
+	}
+	if s.OutputDir == "" {
+		return render.OutputStdout
+	}
+	return render.OutputDir
+}
+
+// RenderOptions returns the render options selected by the settings. The
+// templates and the sink are left to the caller.
+func (s *Settings) RenderOptions() (render.Options, error) {
+	strategy, err := templates.ParseMergeStrategy(s.MergeStrategy)
+	if err != nil {
+		return render.Options{}, err
+	}
+	var fileMode uint64
+	if s.FileMode != "" {
+		fileMode, err = strconv.ParseUint(s.FileMode, 8, 32)
+		if err != nil || fileMode > 0777 {
+			return render.Options{}, errors.Errorf("--file-mode %q is not an octal file mode", s.FileMode)
+		}
+	}
+	if s.Jobs < 1 {
+		return render.Options{}, errors.Errorf("--jobs must be at least 1, got %d", s.Jobs)
+	}
+	var cacheFile string
+	if s.Cache {
+		if s.OutputDir == "" {
+			return render.Options{}, errors.New("--cache needs an output path (-o)")
+		}
+		cacheFile = s.cacheFile()
+	}
+	g := getter.New(s.ValuesTimeout)
+	g.CacheDir = s.ValuesCacheDir
+	g.Offline = s.Offline
+	return render.Options{
+		InputDir:        s.InputDir,
+		Include:         s.Include,
+		Exclude:         s.Exclude,
+		Matrix:          s.Matrix,
+		Libs:            s.Libs,
+		Jobs:            s.Jobs,
+		OutputDir:       s.OutputDir,
+		ValuesFiles:     s.ValuesFiles,
+		ValuesFormat:    s.ValuesFormat,
+		Getter:          g,
+		Merge:           templates.MergeOptions{Strategy: strategy, ListKey: s.MergeKey},
+		EnvValuesPrefix: s.EnvValuesPrefix,
+		Overrides:       s.Overrides,
+		SchemaFile:      s.SchemaFile,
+		Strict:          s.Strict,
+		FlatValues:      s.FlatValues,
+		Version:         Version,
+		AllowEnv:        s.AllowEnv,
+		Validate:        s.Validate,
+		FileMode:        os.FileMode(fileMode),
+		CacheFile:       cacheFile,
+	}, nil
+}
+
+// cacheFile returns the path of the cache file, a hidden file next to the
+// output: out/ is cached in .out.cache.json.
+func (s *Settings) cacheFile() string {
+	out := filepath.Clean(s.OutputDir)
+	return filepath.Join(filepath.Dir(out), "."+filepath.Base(out)+".cache.json")
 }
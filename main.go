@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"github.com/spf13/cobra"
 	"log"
 	"os"
@@ -14,7 +15,7 @@ func init() {
 func main() {
 	rootCmd, err := cmd.NewRootCmd(os.Stdout, os.Args[1:])
 	if err != nil {
-		log.Printf("%+v\n", err)
+		log.Printf("%v\n", err)
 		os.Exit(1)
 	}
 
@@ -24,7 +25,11 @@ func main() {
 	})
 
 	if err := rootCmd.Execute(); err != nil {
-		log.Printf("%+v\n", err)
+		log.Printf("%v\n", err)
+		var diffErr cmd.DiffError
+		if errors.As(err, &diffErr) {
+			os.Exit(cmd.DiffExitCode)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"yaml-template-cli/pkg/templates"
+)
+
+// cacheVersion is part of every fingerprint, so a change of the way outputs
+// are rendered invalidates the caches.
+const cacheVersion = "3"
+
+// Cache keeps the outputs of a render with what they depend on, so a later
+// render can reuse the outputs whose templates, named templates and values
+// read are unchanged instead of executing them again.
+type Cache struct {
+	// Entries are keyed like the map returned by Render.
+	Entries map[string]CacheEntry `json:"entries"`
+	// Hits is the number of outputs reused by the last render.
+	Hits int `json:"-"`
+}
+
+// CacheEntry is a cached output.
+type CacheEntry struct {
+	// Fingerprint is a hash of everything the output depends on.
+	Fingerprint string `json:"fingerprint"`
+	// Dependencies are the named templates and values it depends on.
+	Dependencies Dependencies `json:"dependencies"`
+	Output       string       `json:"output"`
+}
+
+// fingerprint hashes what the output of a job depends on: the templates and
+// named templates it executes, and the values it reads in its data.
+func (e Engine) fingerprint(t *template.Template, j job, deps Dependencies) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t\x00%s\x00", cacheVersion, j.filename, j.key, e.Strict, strings.Join(e.AllowEnv, ","))
+	for _, name := range append([]string{j.filename}, deps.Templates...) {
+		var text string
+		if tmpl := t.Lookup(name); tmpl != nil && tmpl.Tree != nil {
+			text = tmpl.Tree.Root.String()
+		}
+		fmt.Fprintf(h, "template %q\x00%s\x00", name, text)
+	}
+	for _, path := range deps.Paths() {
+		v := lookupPath(j.vals, templates.SplitKeys(path))
+		if deps.Values[path] == ReadTruth {
+			truth, _ := template.IsTrue(v)
+			fmt.Fprintf(h, "truth %q\x00%t\x00", path, truth)
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			// e.g. a map with keys that are not strings
+			data = []byte(fmt.Sprintf("%#v", v))
+		}
+		fmt.Fprintf(h, "value %q\x00%s\x00", path, data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookupPath returns the value at the path of keys of data, nil when missing.
+// When the path goes through something it can't look into, like a method
+// call, e.g. .Files.Get, the value reached so far is returned, so everything
+// the template may read is part of the fingerprint.
+func lookupPath(data interface{}, keys []string) interface{} {
+	for _, key := range keys {
+		switch m := data.(type) {
+		case templates.Values:
+			data = m[key]
+			continue
+		case map[string]interface{}:
+			data = m[key]
+			continue
+		}
+		v := reflect.ValueOf(data)
+		if !v.IsValid() {
+			return nil
+		}
+		if v.MethodByName(key).IsValid() {
+			return data
+		}
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		switch {
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			e := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+			if !e.IsValid() {
+				return nil
+			}
+			data = e.Interface()
+		case v.Kind() == reflect.Struct:
+			f := v.FieldByName(key)
+			if !f.IsValid() || !f.CanInterface() {
+				return data
+			}
+			data = f.Interface()
+		default:
+			return data
+		}
+	}
+	return data
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"testing"
+
+	"yaml-template-cli/pkg/templates"
+)
+
+// renderCached renders files with values through cache and returns the
+// outputs.
+func renderCached(t *testing.T, cache *Cache, files map[string]string, values templates.Values, data map[string][]byte) map[string]string {
+	t.Helper()
+	tpl := &templates.Template{Values: values, Files: data}
+	for name, text := range files {
+		tpl.Templates = append(tpl.Templates, templates.File{Name: name, Data: []byte(text)})
+	}
+	out, err := Engine{Cache: cache}.Render(tpl, tpl.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCacheHits(t *testing.T) {
+	files := map[string]string{
+		"a.yaml": `a: {{ .Values.a }}`,
+		"b.yaml": `b: {{ .Values.b }}`,
+	}
+	cache := &Cache{}
+	renderCached(t, cache, files, templates.Values{"a": 1, "b": 1}, nil)
+	if cache.Hits != 0 {
+		t.Errorf("got %d hits on an empty cache", cache.Hits)
+	}
+	out := renderCached(t, cache, files, templates.Values{"a": 1, "b": 1}, nil)
+	if cache.Hits != 2 {
+		t.Errorf("got %d hits when nothing changed, want 2", cache.Hits)
+	}
+	if out["a.yaml"] != "a: 1" || out["b.yaml"] != "b: 1" {
+		t.Errorf("got cached outputs %q", out)
+	}
+
+	// Only a.yaml reads a.
+	out = renderCached(t, cache, files, templates.Values{"a": 2, "b": 1}, nil)
+	if cache.Hits != 1 {
+		t.Errorf("got %d hits when a value read by one template changed, want 1", cache.Hits)
+	}
+	if out["a.yaml"] != "a: 2" {
+		t.Errorf("got %q for a.yaml, want the new value", out["a.yaml"])
+	}
+
+	// A value no template reads.
+	renderCached(t, cache, files, templates.Values{"a": 2, "b": 1, "c": 1}, nil)
+	if cache.Hits != 2 {
+		t.Errorf("got %d hits when a value nothing reads changed, want 2", cache.Hits)
+	}
+}
+
+func TestCacheTruth(t *testing.T) {
+	files := map[string]string{"a.yaml": `{{ if .Values.on }}on{{ end }}`}
+	cache := &Cache{}
+	renderCached(t, cache, files, templates.Values{"on": "yes"}, nil)
+	renderCached(t, cache, files, templates.Values{"on": "sure"}, nil)
+	if cache.Hits != 1 {
+		t.Errorf("got %d hits when a tested value stayed true, want 1", cache.Hits)
+	}
+	out := renderCached(t, cache, files, templates.Values{"on": ""}, nil)
+	if cache.Hits != 0 || out["a.yaml"] != "" {
+		t.Errorf("got %d hits and %q when a tested value became false", cache.Hits, out["a.yaml"])
+	}
+}
+
+func TestCacheNamedTemplates(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"literal name", `{{ include "h" . }}`},
+		{"computed name", `{{ include (printf "%s" .Values.which) . }}`},
+		{"variable name", `{{ $n := .Values.which }}{{ include $n . }}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := templates.Values{"which": "h"}
+			cache := &Cache{}
+			files := map[string]string{
+				"_h.yaml": `{{ define "h" }}old{{ end }}`,
+				"a.yaml":  tt.text,
+			}
+			renderCached(t, cache, files, values, nil)
+			files["_h.yaml"] = `{{ define "h" }}new{{ end }}`
+			out := renderCached(t, cache, files, values, nil)
+			if out["a.yaml"] != "new" {
+				t.Errorf("got %q after the named template changed, want %q", out["a.yaml"], "new")
+			}
+		})
+	}
+}
+
+func TestCacheDynamic(t *testing.T) {
+	files := map[string]string{"a.yaml": `{{ now | date "2006" }}`}
+	cache := &Cache{}
+	renderCached(t, cache, files, nil, nil)
+	renderCached(t, cache, files, nil, nil)
+	if cache.Hits != 0 {
+		t.Errorf("got %d hits for a template calling now, want 0", cache.Hits)
+	}
+}
+
+func TestCacheDottedKeys(t *testing.T) {
+	files := map[string]string{"a.yaml": `{{ index .Values.labels "app.kubernetes.io/name" }}`}
+	labels := func(name string) templates.Values {
+		return templates.Values{"labels": map[string]interface{}{"app.kubernetes.io/name": name}}
+	}
+	cache := &Cache{}
+	renderCached(t, cache, files, labels("one"), nil)
+	out := renderCached(t, cache, files, labels("two"), nil)
+	if out["a.yaml"] != "two" {
+		t.Errorf("got %q after a value under a key holding dots changed, want %q", out["a.yaml"], "two")
+	}
+}
+
+func TestCacheFiles(t *testing.T) {
+	files := map[string]string{"a.yaml": `{{ .Files.Get "conf" }}`}
+	cache := &Cache{}
+	renderCached(t, cache, files, nil, map[string][]byte{"conf": []byte("old")})
+	out := renderCached(t, cache, files, nil, map[string][]byte{"conf": []byte("new")})
+	if out["a.yaml"] != "new" {
+		t.Errorf("got %q after the file changed, want %q", out["a.yaml"], "new")
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	data := templates.Values{
+		"Values": templates.Values{"a": map[string]interface{}{"b": 1}},
+		"Env":    map[string]string{"HOME": "/root"},
+		"Files":  files{"conf": []byte("x")},
+		"Render": Info{Version: "v1"},
+	}
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"Values.a.b", 1},
+		{"Values.missing", nil},
+		{`Values.a\.b`, nil},
+		{"Env.HOME", "/root"},
+		{"Env.MISSING", nil},
+		{"Render.Version", "v1"},
+	}
+	for _, tt := range tests {
+		if got := lookupPath(data, templates.SplitKeys(tt.path)); got != tt.want {
+			t.Errorf("lookupPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	// A method call can't be looked into, the whole files are returned.
+	if got, ok := lookupPath(data, []string{"Files", "Get"}).(files); !ok || len(got) != 1 {
+		t.Errorf("lookupPath(Files.Get) = %v, want the files", got)
+	}
+}
@@ -0,0 +1,531 @@
+package engine
+
+import (
+	"sort"
+	"text/template"
+	"text/template/parse"
+
+	"yaml-template-cli/pkg/templates"
+)
+
+// dynamicFuncs are the functions whose result depends on more than their
+// arguments. The output of a templates calling one of them can't be predicted
+// from its dependencies.
+var dynamicFuncs = map[string]bool{
+	"tpl":                      true,
+	"env":                      true,
+	"expandenv":                true,
+	"now":                      true,
+	"ago":                      true,
+	"randAlpha":                true,
+	"randAlphaNum":             true,
+	"randAscii":                true,
+	"randNumeric":              true,
+	"randBytes":                true,
+	"randInt":                  true,
+	"uuidv4":                   true,
+	"shuffle":                  true,
+	"bcrypt":                   true,
+	"htpasswd":                 true,
+	"encryptAES":               true,
+	"genPrivateKey":            true,
+	"genCA":                    true,
+	"genCAWithKey":             true,
+	"genSelfSignedCert":        true,
+	"genSelfSignedCertWithKey": true,
+	"genSignedCert":            true,
+	"genSignedCertWithKey":     true,
+	"getHostByName":            true,
+}
+
+// ReadMode tells how much of a value a templates reads.
+type ReadMode string
+
+const (
+	// ReadWhole reads the value and everything below it, e.g. {{ .a }} or
+	// {{ toYaml .a }}.
+	ReadWhole ReadMode = "whole"
+	// ReadTruth only tests whether the value is empty, e.g. {{ if .a }}.
+	ReadTruth ReadMode = "truth"
+)
+
+// Dependencies are what the output of a templates depends on, found by
+// walking its parse tree.
+type Dependencies struct {
+	// Templates are the named templates it executes, directly or not.
+	Templates []string `json:"templates,omitempty"`
+	// Values are the paths it reads in the data it is executed with, e.g.
+	// "db.host", joined by templates.JoinKeys. The empty path is the data
+	// itself.
+	Values map[string]ReadMode `json:"values,omitempty"`
+	// Dynamic is set when the output also depends on something else, e.g.
+	// the environment, the time, a templates built at render time or a
+	// named templates whose name is computed.
+	Dynamic bool `json:"dynamic,omitempty"`
+}
+
+// Paths returns the paths of the values read, sorted.
+func (d Dependencies) Paths() []string {
+	paths := make([]string, 0, len(d.Values))
+	for p := range d.Values {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// dotCtx is what dot, or a variable, holds while walking a tree.
+type dotCtx struct {
+	// known is set when the value comes from the data at path. Otherwise it
+	// was built by a function, from arguments whose reads were recorded.
+	known bool
+	path  []string
+	// collapsed contexts stand for an element of the list or map at path:
+	// reading anything below them reads the whole path.
+	collapsed bool
+}
+
+var unknownCtx = dotCtx{}
+
+func (c dotCtx) field(idents ...string) dotCtx {
+	if !c.known || c.collapsed || len(idents) == 0 {
+		return c
+	}
+	path := make([]string, 0, len(c.path)+len(idents))
+	path = append(append(path, c.path...), idents...)
+	return dotCtx{known: true, path: path}
+}
+
+func (c dotCtx) key() string {
+	if !c.known {
+		return "?"
+	}
+	if c.collapsed {
+		return "*" + templates.JoinKeys(c.path...)
+	}
+	return templates.JoinKeys(c.path...)
+}
+
+// analyzer walks the trees of a parsed set of templates.
+type analyzer struct {
+	t         *template.Template
+	templates map[string]bool
+	values    map[string]ReadMode
+	dynamic   bool
+	// includes are the named templates each templates executes directly.
+	includes map[string]map[string]bool
+	// visited guards against walking a templates twice with the same dot,
+	// stack against recursive templates.
+	visited map[string]bool
+	stack   map[string]bool
+	// reads, when set, collects every read with its location.
+	reads *[]Read
+	// optional is set while walking the arguments of 'default'.
+	optional bool
+}
+
+// Read is a values path read by a templates.
+type Read struct {
+	// Path is joined by templates.JoinKeys.
+	Path string
+	Mode ReadMode
+	// Location is where it is read, e.g. "in/a.yaml:3:10".
+	Location string
+	// Optional is set when a missing value is expected, i.e. the value is
+	// only tested, or given a default.
+	Optional bool
+}
+
+func newAnalyzer(t *template.Template) *analyzer {
+	return &analyzer{
+		t:         t,
+		templates: map[string]bool{},
+		values:    map[string]ReadMode{},
+		includes:  map[string]map[string]bool{},
+		visited:   map[string]bool{},
+		stack:     map[string]bool{},
+	}
+}
+
+// dependencies returns what was found since the last call, and resets it.
+func (a *analyzer) dependencies() Dependencies {
+	deps := Dependencies{Values: a.values, Dynamic: a.dynamic}
+	for name := range a.templates {
+		deps.Templates = append(deps.Templates, name)
+	}
+	sort.Strings(deps.Templates)
+	a.templates, a.values, a.dynamic = map[string]bool{}, map[string]ReadMode{}, false
+	a.visited = map[string]bool{}
+	return deps
+}
+
+// template walks the named templates executed with dot.
+func (a *analyzer) template(name string, dot dotCtx) {
+	key := name + "\x00" + dot.key()
+	if a.visited[key] {
+		return
+	}
+	a.visited[key] = true
+	if a.stack[name] {
+		// A recursive templates may read anything below its data.
+		a.read(name, dot, ReadWhole, nil)
+		return
+	}
+	tmpl := a.t.Lookup(name)
+	if tmpl == nil || tmpl.Tree == nil {
+		return
+	}
+	a.stack[name] = true
+	defer delete(a.stack, name)
+	a.list(name, tmpl.Tree.Root, dot, map[string]dotCtx{"$": dot})
+}
+
+// execute records that the templates from executes the named templates name
+// with the data arg, and walks it.
+func (a *analyzer) execute(from, name string, arg parse.Node, dot dotCtx, vars map[string]dotCtx) {
+	a.templates[name] = true
+	if a.includes[from] == nil {
+		a.includes[from] = map[string]bool{}
+	}
+	a.includes[from][name] = true
+	argCtx := unknownCtx
+	if arg != nil {
+		var ok bool
+		if argCtx, ok = a.ref(from, arg, dot, vars); !ok {
+			a.arg(from, arg, dot, vars)
+		}
+	}
+	a.template(name, argCtx)
+}
+
+// read records that the templates name reads c at the node n.
+func (a *analyzer) read(name string, c dotCtx, mode ReadMode, n parse.Node) {
+	if !c.known {
+		return
+	}
+	if c.collapsed {
+		mode = ReadWhole
+	}
+	path := templates.JoinKeys(c.path...)
+	if a.values[path] != ReadWhole {
+		a.values[path] = mode
+	}
+	if a.reads != nil {
+		read := Read{Path: path, Mode: mode, Location: name, Optional: a.optional || mode == ReadTruth}
+		if tmpl := a.t.Lookup(name); n != nil && tmpl != nil && tmpl.Tree != nil {
+			read.Location, _ = tmpl.Tree.ErrorContext(n)
+		}
+		*a.reads = append(*a.reads, read)
+	}
+}
+
+func (a *analyzer) list(name string, list *parse.ListNode, dot dotCtx, vars map[string]dotCtx) {
+	if list == nil {
+		return
+	}
+	for _, n := range list.Nodes {
+		a.node(name, n, dot, vars)
+	}
+}
+
+func (a *analyzer) node(name string, n parse.Node, dot dotCtx, vars map[string]dotCtx) {
+	switch n := n.(type) {
+	case *parse.ActionNode:
+		mode := ReadWhole
+		if len(n.Pipe.Decl) > 0 {
+			mode = ""
+		}
+		a.pipe(name, n.Pipe, dot, vars, mode)
+	case *parse.IfNode:
+		body := copyVars(vars)
+		a.pipe(name, n.Pipe, dot, body, ReadTruth)
+		a.list(name, n.List, dot, copyVars(body))
+		a.list(name, n.ElseList, dot, body)
+	case *parse.WithNode:
+		body := copyVars(vars)
+		c := a.pipe(name, n.Pipe, dot, body, ReadTruth)
+		a.list(name, n.List, c, body)
+		a.list(name, n.ElseList, dot, copyVars(vars))
+	case *parse.RangeNode:
+		body := copyVars(vars)
+		c := a.pipe(name, n.Pipe, dot, body, ReadWhole)
+		if c.known {
+			c.collapsed = true
+		}
+		for i, v := range n.Pipe.Decl {
+			// range $key, $element := ...
+			if i == len(n.Pipe.Decl)-1 {
+				body[v.Ident[0]] = c
+			} else {
+				body[v.Ident[0]] = unknownCtx
+			}
+		}
+		a.list(name, n.List, c, body)
+		a.list(name, n.ElseList, dot, copyVars(vars))
+	case *parse.TemplateNode:
+		var arg parse.Node
+		if n.Pipe != nil {
+			arg = n.Pipe
+			if len(n.Pipe.Cmds) == 1 && len(n.Pipe.Cmds[0].Args) == 1 {
+				arg = n.Pipe.Cmds[0].Args[0]
+			}
+		}
+		a.execute(name, n.Name, arg, dot, vars)
+	case *parse.ListNode:
+		a.list(name, n, dot, vars)
+	}
+}
+
+// pipe walks a pipeline and returns what its value holds. mode is how its
+// value is read when it is a plain reference, e.g. {{ .a }}; an empty mode
+// means it is only assigned to variables.
+func (a *analyzer) pipe(name string, p *parse.PipeNode, dot dotCtx, vars map[string]dotCtx, mode ReadMode) dotCtx {
+	if p == nil {
+		return unknownCtx
+	}
+	result := unknownCtx
+	for i, cmd := range p.Cmds {
+		last := i == len(p.Cmds)-1
+		if c, ok := a.plainRef(name, cmd, dot, vars); ok {
+			result = c
+			if !last {
+				// .a | default "x"
+				optional := a.optional
+				a.optional = a.optional || isCall(p.Cmds[i+1], "default")
+				a.read(name, c, ReadWhole, cmd)
+				a.optional = optional
+			} else if mode != "" {
+				a.read(name, c, mode, cmd)
+			}
+			continue
+		}
+		a.command(name, cmd, dot, vars)
+		result = unknownCtx
+	}
+	for _, v := range p.Decl {
+		vars[v.Ident[0]] = result
+	}
+	return result
+}
+
+// plainRef returns the context of a command that is a single reference, e.g.
+// .a.b or $x.
+func (a *analyzer) plainRef(name string, cmd *parse.CommandNode, dot dotCtx, vars map[string]dotCtx) (dotCtx, bool) {
+	if len(cmd.Args) != 1 {
+		return unknownCtx, false
+	}
+	return a.ref(name, cmd.Args[0], dot, vars)
+}
+
+// ref returns the context of a reference to the data.
+func (a *analyzer) ref(name string, n parse.Node, dot dotCtx, vars map[string]dotCtx) (dotCtx, bool) {
+	switch n := n.(type) {
+	case *parse.DotNode:
+		return dot, true
+	case *parse.FieldNode:
+		return dot.field(n.Ident...), true
+	case *parse.VariableNode:
+		c, ok := vars[n.Ident[0]]
+		if !ok {
+			return unknownCtx, true
+		}
+		return c.field(n.Ident[1:]...), true
+	case *parse.ChainNode:
+		if c, ok := a.ref(name, n.Node, dot, vars); ok {
+			return c.field(n.Field...), true
+		}
+		if p, ok := n.Node.(*parse.PipeNode); ok {
+			c := a.pipe(name, p, dot, vars, "")
+			return c.field(n.Field...), true
+		}
+	case *parse.PipeNode:
+		if len(n.Decl) == 0 && len(n.Cmds) == 1 {
+			return a.plainRef(name, n.Cmds[0], dot, vars)
+		}
+	}
+	return unknownCtx, false
+}
+
+// command walks a function call.
+func (a *analyzer) command(name string, cmd *parse.CommandNode, dot dotCtx, vars map[string]dotCtx) {
+	args := cmd.Args
+	if id, ok := args[0].(*parse.IdentifierNode); ok {
+		switch {
+		case dynamicFuncs[id.Ident]:
+			a.dynamic = true
+		case id.Ident == "include" && len(args) >= 2:
+			if s, ok := args[1].(*parse.StringNode); ok {
+				var arg parse.Node
+				if len(args) > 2 {
+					arg = args[2]
+				}
+				a.execute(name, s.Text, arg, dot, vars)
+				return
+			}
+			// The named templates is only known at render time, e.g.
+			// include (printf "%s" .Values.which) ., so it may be any.
+			a.dynamic = true
+		case id.Ident == "index" && len(args) >= 3:
+			// index .a "b" "c" reads a.b.c
+			if c, ok := a.ref(name, args[1], dot, vars); ok {
+				keys := make([]string, 0, len(args)-2)
+				for _, arg := range args[2:] {
+					if s, ok := arg.(*parse.StringNode); ok {
+						keys = append(keys, s.Text)
+					}
+				}
+				if len(keys) == len(args)-2 {
+					a.read(name, c.field(keys...), ReadWhole, args[1])
+					return
+				}
+			}
+		}
+		if id.Ident == "default" {
+			optional := a.optional
+			a.optional = true
+			defer func() { a.optional = optional }()
+		}
+		args = args[1:]
+	}
+	for _, arg := range args {
+		a.arg(name, arg, dot, vars)
+	}
+}
+
+// isCall tells whether a command calls the function fn.
+func isCall(cmd *parse.CommandNode, fn string) bool {
+	id, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && id.Ident == fn
+}
+
+// arg walks a function argument, which is read whole.
+func (a *analyzer) arg(name string, n parse.Node, dot dotCtx, vars map[string]dotCtx) {
+	if c, ok := a.ref(name, n, dot, vars); ok {
+		a.read(name, c, ReadWhole, n)
+		return
+	}
+	switch n := n.(type) {
+	case *parse.PipeNode:
+		a.pipe(name, n, dot, vars, ReadWhole)
+	case *parse.ChainNode:
+		a.arg(name, n.Node, dot, vars)
+	}
+}
+
+func copyVars(vars map[string]dotCtx) map[string]dotCtx {
+	out := make(map[string]dotCtx, len(vars))
+	for k, v := range vars {
+		out[k] = v
+	}
+	return out
+}
+
+// Graph is the dependency graph of a set of templates.
+type Graph struct {
+	// Files are the templates files that are rendered.
+	Files []GraphNode `json:"files"`
+	// Defines are the named templates.
+	Defines []GraphNode `json:"defines"`
+}
+
+// GraphNode is a templates file or a named templates of a Graph.
+type GraphNode struct {
+	Name string `json:"name"`
+	// File is the templates file holding a named templates.
+	File string `json:"file,omitempty"`
+	// Includes are the named templates it executes directly.
+	Includes []string `json:"includes,omitempty"`
+	// Values are the paths of the data a templates file reads, directly or
+	// through named templates, e.g. Values.image.tag, joined by
+	// templates.JoinKeys. The empty path is the whole data.
+	Values []string `json:"values,omitempty"`
+	// Dynamic is set when the output of a templates file also depends on
+	// something else than its templates and values.
+	Dynamic bool `json:"dynamic,omitempty"`
+}
+
+// Graph parses the templates and returns their dependency graph.
+func (e Engine) Graph(tpl *templates.Template) (*Graph, error) {
+	tmap := renderables(tpl)
+	t, keys, err := e.parse(tmap, &linter{})
+	if err != nil {
+		return nil, err
+	}
+	a := newAnalyzer(t)
+	graph := &Graph{Files: []GraphNode{}, Defines: []GraphNode{}}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, filename := range sorted {
+		if !executable(filename, tmap[filename]) {
+			continue
+		}
+		a.template(filename, dotCtx{known: true})
+		deps := a.dependencies()
+		graph.Files = append(graph.Files, GraphNode{
+			Name:    filename,
+			Values:  deps.Paths(),
+			Dynamic: deps.Dynamic,
+		})
+	}
+	// The file of a named templates is the last one parsed defining it.
+	files := map[string]string{}
+	for _, filename := range keys {
+		for name := range definitions(filename, tmap[filename].tpl) {
+			files[name] = filename
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Walk the named templates nothing executes too, for their includes.
+		a.template(name, unknownCtx)
+		a.dependencies()
+		graph.Defines = append(graph.Defines, GraphNode{Name: name, File: files[name]})
+	}
+	for i, node := range graph.Files {
+		graph.Files[i].Includes = sortedKeys(a.includes[node.Name])
+	}
+	for i, node := range graph.Defines {
+		graph.Defines[i].Includes = sortedKeys(a.includes[node.Name])
+	}
+	return graph, nil
+}
+
+// Reads parses the templates and returns, for every templates file that is
+// rendered, the values paths it reads, directly or through named templates,
+// in the order they appear.
+func (e Engine) Reads(tpl *templates.Template) (map[string][]Read, error) {
+	tmap := renderables(tpl)
+	t, keys, err := e.parse(tmap, &linter{})
+	if err != nil {
+		return nil, err
+	}
+	a := newAnalyzer(t)
+	reads := map[string][]Read{}
+	for _, filename := range keys {
+		if !executable(filename, tmap[filename]) {
+			continue
+		}
+		fileReads := []Read{}
+		a.reads = &fileReads
+		a.template(filename, dotCtx{known: true})
+		a.dependencies()
+		reads[filename] = fileReads
+	}
+	return reads, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -3,12 +3,15 @@ package engine
 import (
 	"fmt"
 	"github.com/pkg/errors"
-	"log"
+	"os"
 	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"text/template/parse"
+	"time"
 	"yaml-template-cli/pkg/templates"
 )
 
@@ -28,6 +31,31 @@ type Engine struct {
 	Strict bool
 	// In LintMode, some 'required' templates values may be missing, so don't fail
 	LintMode bool
+	// AllowEnv enables the 'env' and 'expandenv' functions for the environment
+	// variables matching one of its prefixes or glob patterns.
+	AllowEnv []string
+	// Jobs is the number of templates executed in parallel, one when zero.
+	Jobs int
+	// Cache, when set, provides the outputs whose dependencies did not
+	// change since they were cached, and is updated with the new outputs.
+	// It is not used in LintMode.
+	Cache *Cache
+	// FlatValues executes the templates with the values as the root of
+	// their data, next to .Template, the way older versions did, instead of
+	// the context described by Context.
+	FlatValues bool
+	// Info describes the render to the templates, as .Render.
+	Info Info
+}
+
+// Info describes a render.
+type Info struct {
+	// Time is when the render started.
+	Time time.Time
+	// Version is the version of the tool rendering the templates.
+	Version string
+	// InputDir is the directory holding the templates.
+	InputDir string
 }
 
 func Render(tpl *templates.Template, values templates.Values) (map[string]string, error) {
@@ -35,15 +63,54 @@ func Render(tpl *templates.Template, values templates.Values) (map[string]string
 }
 
 func (e Engine) Render(tpl *templates.Template, values templates.Values) (map[string]string, error) {
+	return e.render(renderables(tpl))
+}
+
+func renderables(tpl *templates.Template) map[string]renderable {
 	tmap := make(map[string]renderable)
 	for _, file := range tpl.Templates {
 		tmap[file.Name] = renderable{
 			tpl:      string(file.Data),
 			vals:     tpl.Values,
+			files:    tpl.Files,
 			basePath: "",
+			matrix:   file.Matrix,
+			items:    file.Items,
+			library:  file.Library,
 		}
 	}
-	return e.render(tmap)
+	return tmap
+}
+
+// executable tells whether a templates file is executed for an output.
+// Partials and libraries are only included from other templates.
+func executable(filename string, r renderable) bool {
+	return !strings.HasPrefix(path.Base(filename), "_") && !r.library
+}
+
+// RenderText renders a single templates text that is not a file, e.g. an output
+// file name, with the same functions as the templates files.
+func (e Engine) RenderText(name, text string, values templates.Values) (rendered string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("rendering templates failed: %v", r)
+		}
+	}()
+	t := template.New(name)
+	if e.Strict {
+		t.Option("missingkey=error")
+	} else {
+		t.Option("missingkey=zero")
+	}
+	e.initFunMap(t, &linter{current: name})
+	if _, err := t.Parse(text); err != nil {
+		return "", cleanupParseError(name, err)
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, values); err != nil {
+		return "", cleanupExecError(name, err)
+	}
+	return strings.ReplaceAll(buf.String(), "<no value>", ""), nil
 }
 
 // render takes a map of templates/values and renders them.
@@ -60,6 +127,72 @@ func (e Engine) render(tpls map[string]renderable) (rendered map[string]string,
 			err = errors.Errorf("rendering templates failed: %v", r)
 		}
 	}()
+	lint := &linter{}
+	t, keys, err := e.parse(tpls, lint)
+	if err != nil {
+		return map[string]string{}, err
+	}
+
+	// Every output is a job. The jobs are spread over e.Jobs workers and
+	// their results are gathered in job order, so the outcome does not
+	// depend on the scheduling.
+	var jobs []job
+	for _, filename := range keys {
+		// Don't render partials. We don't care out the direct output of partials.
+		// They are only included from other templates.
+		if !executable(filename, tpls[filename]) {
+			continue
+		}
+		// Templates that failed to parse were already reported by the linter.
+		if t.Lookup(filename) == nil {
+			continue
+		}
+		r := tpls[filename]
+		if !r.matrix {
+			vals := e.context(r.vals, r.files, filename, r.basePath)
+			jobs = append(jobs, job{filename: filename, key: filename, vals: vals})
+			continue
+		}
+		// A matrix templates is executed once per item.
+		for i, item := range r.items {
+			vals := e.matrixContext(r.vals, r.files, filename, r.basePath, item, i)
+			jobs = append(jobs, job{filename: filename, key: MatrixKey(filename, i), vals: vals})
+		}
+	}
+
+	results, err := e.runCached(t, jobs)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	rendered = make(map[string]string, len(jobs))
+	failed := map[string]bool{}
+	for i, res := range results {
+		filename := jobs[i].filename
+		if res.err != nil {
+			if !e.LintMode {
+				return map[string]string{}, res.err
+			}
+			// Only the first failing item of a matrix templates is reported.
+			if !failed[filename] {
+				lint.add(filename, res.err)
+			}
+			failed[filename] = true
+		}
+		lint.messages = append(lint.messages, res.lint...)
+		if res.err == nil {
+			rendered[jobs[i].key] = res.out
+		}
+	}
+
+	if len(lint.messages) > 0 {
+		return rendered, lint.messages
+	}
+	return rendered, nil
+}
+
+// parse parses all the templates into a single set, in a predictable order.
+// In LintMode, the problems are added to lint instead of being returned.
+func (e Engine) parse(tpls map[string]renderable, lint *linter) (*template.Template, []string, error) {
 	t := template.New("gotpl")
 	if e.Strict {
 		t.Option("missingkey=error")
@@ -69,45 +202,234 @@ func (e Engine) render(tpls map[string]renderable) (rendered map[string]string,
 		t.Option("missingkey=zero")
 	}
 
-	e.initFunMap(t)
+	e.initFunMap(t, lint)
 
 	// We want to parse the templates in a predictable order. The order favors
 	// higher-level (in file system) templates over deeply nested templates.
+	// Libraries are parsed first, so the local templates override their
+	// definitions.
 	keys := sortTemplates(tpls)
 
+	if err := checkDefinitions(tpls, keys); err != nil {
+		if !e.LintMode {
+			return nil, nil, err
+		}
+		for _, msg := range err.(LintError) {
+			lint.messages = append(lint.messages, msg)
+		}
+	}
+
 	for _, filename := range keys {
 		r := tpls[filename]
 		if _, err := t.New(filename).Parse(r.tpl); err != nil {
-			return map[string]string{}, cleanupParseError(filename, err)
+			if e.LintMode {
+				lint.add(filename, cleanupParseError(filename, err))
+				continue
+			}
+			return nil, nil, cleanupParseError(filename, err)
 		}
 	}
+	return t, keys, nil
+}
 
-	rendered = make(map[string]string, len(keys))
-	for _, filename := range keys {
-		// Don't render partials. We don't care out the direct output of partials.
-		// They are only included from other templates.
-		if strings.HasPrefix(path.Base(filename), "_") {
+// runCached runs the jobs whose output is not in e.Cache, then replaces the
+// entries of the cache by the outputs of this render.
+func (e Engine) runCached(t *template.Template, jobs []job) ([]jobResult, error) {
+	if e.Cache == nil || e.LintMode {
+		return e.run(t, jobs)
+	}
+	a := newAnalyzer(t)
+	deps := map[string]Dependencies{}
+	fingerprints := make([]string, len(jobs))
+	results := make([]jobResult, len(jobs))
+	var pending []job
+	var pendingIndex []int
+	e.Cache.Hits = 0
+	for i, j := range jobs {
+		d, ok := deps[j.filename]
+		if !ok {
+			a.template(j.filename, dotCtx{known: true})
+			d = a.dependencies()
+			deps[j.filename] = d
+		}
+		if !d.Dynamic {
+			fingerprints[i] = e.fingerprint(t, j, d)
+			if entry, ok := e.Cache.Entries[j.key]; ok && entry.Fingerprint == fingerprints[i] {
+				results[i] = jobResult{out: entry.Output}
+				e.Cache.Hits++
+				continue
+			}
+		}
+		pending = append(pending, j)
+		pendingIndex = append(pendingIndex, i)
+	}
+	executed, err := e.run(t, pending)
+	if err != nil {
+		return nil, err
+	}
+	for k, res := range executed {
+		results[pendingIndex[k]] = res
+	}
+	entries := make(map[string]CacheEntry, len(jobs))
+	for i, j := range jobs {
+		if fingerprints[i] == "" || results[i].err != nil {
 			continue
 		}
-		// At render time, add information about the templates that is being rendered.
-		vals := tpls[filename].vals
-		vals["Template"] = templates.Values{"Name": filename, "BasePath": tpls[filename].basePath}
-		var buf strings.Builder
-		if err := t.ExecuteTemplate(&buf, filename, vals); err != nil {
-			return map[string]string{}, cleanupExecError(filename, err)
+		entries[j.key] = CacheEntry{
+			Fingerprint:  fingerprints[i],
+			Dependencies: deps[j.filename],
+			Output:       results[i].out,
 		}
+	}
+	e.Cache.Entries = entries
+	return results, nil
+}
 
-		// Work around the issue where Go will emit "<no value>" even if Options(missing=zero)
-		// is set. Since missing=error will never get here, we do not need to handle
-		// the Strict case.
-		rendered[filename] = strings.ReplaceAll(buf.String(), "<no value>", "")
+// job is one execution of a templates.
+type job struct {
+	filename string
+	// key is the key of the output in the map returned by Render.
+	key  string
+	vals templates.Values
+}
+
+// jobResult is the outcome of a job.
+type jobResult struct {
+	out  string
+	err  error
+	lint LintError
+}
+
+// run executes the jobs on a pool of e.Jobs workers and returns their results
+// in job order. Every worker executes a clone of t with its own functions,
+// so the recursion tracking of 'include' and the problems found in LintMode
+// are kept per execution. Every job gets its own copy of the values, as
+// functions like 'set' modify them, so the outputs don't depend on the order
+// or number of workers.
+func (e Engine) run(t *template.Template, jobs []job) ([]jobResult, error) {
+	results := make([]jobResult, len(jobs))
+	workers := e.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
 	}
+	clones := make([]*template.Template, workers)
+	for w := range clones {
+		clone, err := t.Clone()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot clone templates")
+		}
+		clones[w] = clone
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(t *template.Template) {
+			defer wg.Done()
+			for i := range next {
+				j := jobs[i]
+				j.vals = j.vals.DeepCopy()
+				results[i] = e.runJob(t, j)
+			}
+		}(clones[w])
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, nil
+}
 
-	return rendered, nil
+// runJob executes a single job on t.
+func (e Engine) runJob(t *template.Template, j job) (res jobResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = jobResult{err: errors.Errorf("rendering templates failed: %v", r)}
+		}
+	}()
+	lint := &linter{current: j.filename}
+	e.initFunMap(t, lint)
+	var buf strings.Builder
+	if err := t.ExecuteTemplate(&buf, j.filename, j.vals); err != nil {
+		return jobResult{err: cleanupExecError(j.filename, err), lint: lint.messages}
+	}
+
+	// Work around the issue where Go will emit "<no value>" even if Options(missing=zero)
+	// is set. Since missing=error will never get here, we do not need to handle
+	// the Strict case.
+	return jobResult{out: strings.ReplaceAll(buf.String(), "<no value>", ""), lint: lint.messages}
+}
+
+// MatrixKey is the key of the output of the index-th item of a matrix
+// templates in the map returned by Render.
+func MatrixKey(filename string, index int) string {
+	return fmt.Sprintf("%s[%d]", filename, index)
+}
+
+// Context returns the data the templates file name of tpl is executed with:
+// the values as .Values, the templates being rendered as .Template, the files
+// of tpl as .Files, the environment variables allowed by AllowEnv as .Env
+// and the Info as .Render. With FlatValues, it is a copy of the values with
+// .Template added.
+func (e Engine) Context(tpl *templates.Template, name string) templates.Values {
+	return e.context(tpl.Values, tpl.Files, name, "")
+}
+
+// MatrixContext returns the data a matrix templates is executed with for one
+// item: the Context with the item as .Item and its index as .Index. With
+// FlatValues, the full values are also added as .Values.
+func (e Engine) MatrixContext(tpl *templates.Template, name string, item interface{}, index int) templates.Values {
+	return e.matrixContext(tpl.Values, tpl.Files, name, "", item, index)
+}
+
+func (e Engine) context(values templates.Values, files map[string][]byte, name, basePath string) templates.Values {
+	// A copy, so a templates changing the top-level values does not change
+	// them for the others.
+	vals := make(templates.Values, len(values)+1)
+	for k, v := range values {
+		vals[k] = v
+	}
+	tplInfo := templates.Values{"Name": name, "BasePath": basePath}
+	if e.FlatValues {
+		vals["Template"] = tplInfo
+		return vals
+	}
+	return templates.Values{
+		"Values":   vals,
+		"Template": tplInfo,
+		"Files":    newFiles(files),
+		"Env":      e.environ(),
+		"Render":   e.Info,
+	}
+}
+
+func (e Engine) matrixContext(values templates.Values, files map[string][]byte, name, basePath string, item interface{}, index int) templates.Values {
+	vals := e.context(values, files, name, basePath)
+	if e.FlatValues {
+		vals["Values"] = values
+	}
+	vals["Item"] = item
+	vals["Index"] = index
+	return vals
+}
+
+// environ returns the environment variables allowed by AllowEnv.
+func (e Engine) environ() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && envAllowed(e.AllowEnv, k) {
+			env[k] = v
+		}
+	}
+	return env
 }
 
 // initFunMap creates the Engine's FuncMap and adds context-specific functions.
-func (e Engine) initFunMap(t *template.Template) {
+func (e Engine) initFunMap(t *template.Template, lint *linter) {
 	funcMap := funcMap()
 	includedNames := make(map[string]int)
 
@@ -115,12 +437,18 @@ func (e Engine) initFunMap(t *template.Template) {
 	funcMap["include"] = includeFun(t, includedNames)
 	funcMap["tpl"] = tplFun(t, includedNames, e.Strict)
 
+	if len(e.AllowEnv) > 0 {
+		for name, fn := range envFuncs(e.AllowEnv) {
+			funcMap[name] = fn
+		}
+	}
+
 	// Add the `required` function here so we can use lintMode
 	funcMap["required"] = func(warn string, val interface{}) (interface{}, error) {
 		if val == nil {
 			if e.LintMode {
 				// Don't fail on missing required values when linting
-				log.Printf("[INFO] Missing required value: %s", warn)
+				lint.add(lint.current, errors.Errorf("missing required value: %s", warn))
 				return "", nil
 			}
 			return val, errors.Errorf(warnWrap(warn))
@@ -128,7 +456,7 @@ func (e Engine) initFunMap(t *template.Template) {
 			if val == "" {
 				if e.LintMode {
 					// Don't fail on missing required values when linting
-					log.Printf("[INFO] Missing required value: %s", warn)
+					lint.add(lint.current, errors.Errorf("missing required value: %s", warn))
 					return "", nil
 				}
 				return val, errors.Errorf(warnWrap(warn))
@@ -141,7 +469,7 @@ func (e Engine) initFunMap(t *template.Template) {
 	funcMap["fail"] = func(msg string) (string, error) {
 		if e.LintMode {
 			// Don't fail when linting
-			log.Printf("[INFO] Fail: %s", msg)
+			lint.add(lint.current, errors.Errorf("fail: %s", msg))
 			return "", nil
 		}
 		return "", errors.New(warnWrap(msg))
@@ -150,14 +478,102 @@ func (e Engine) initFunMap(t *template.Template) {
 	t.Funcs(funcMap)
 }
 
+// LintMessage is a single problem found in a templates while linting.
+type LintMessage struct {
+	Template string
+	Err      error
+}
+
+func (m LintMessage) Error() string {
+	return fmt.Sprintf("%s: %s", m.Template, m.Err)
+}
+
+// LintError holds every problem found by a render in LintMode.
+type LintError []LintMessage
+
+func (e LintError) Error() string {
+	msgs := make([]string, len(e))
+	for i, m := range e {
+		msgs[i] = m.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// linter collects the problems reported during a render in LintMode.
+type linter struct {
+	// current is the templates being executed
+	current  string
+	messages LintError
+}
+
+func (l *linter) add(filename string, err error) {
+	l.messages = append(l.messages, LintMessage{Template: filename, Err: err})
+}
+
 // renderable is an object that can be rendered.
 type renderable struct {
 	// tpl is the current templates.
 	tpl string
 	// vals are the values to be supplied to the templates.
 	vals templates.Values
+	// files are the files supplied to the templates as .Files.
+	files map[string][]byte
 	// namespace prefix to the templates of the current chart
 	basePath string
+	// matrix templates are executed once per element of items.
+	matrix bool
+	items  []interface{}
+	// library templates only provide definitions and are never executed.
+	library bool
+}
+
+// definitions returns the named templates a templates file defines. A file
+// that does not parse defines nothing, its error is reported when the
+// templates are parsed for real.
+func definitions(filename, text string) map[string]bool {
+	tree := parse.New(filename)
+	tree.Mode = parse.SkipFuncCheck
+	treeSet := map[string]*parse.Tree{}
+	if _, err := tree.Parse(text, "", "", treeSet); err != nil {
+		return nil
+	}
+	names := make(map[string]bool, len(treeSet))
+	for name := range treeSet {
+		if name != filename {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// checkDefinitions reports the named templates defined more than once, by
+// two libraries or by two local templates. A local definition overriding a
+// library one is allowed.
+func checkDefinitions(tpls map[string]renderable, keys []string) error {
+	var problems LintError
+	defined := map[bool]map[string]string{true: {}, false: {}}
+	for _, filename := range keys {
+		r := tpls[filename]
+		names := make([]string, 0)
+		for name := range definitions(filename, r.tpl) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prev, ok := defined[r.library][name]; ok {
+				problems = append(problems, LintMessage{
+					Template: filename,
+					Err:      errors.Errorf("template %q is already defined in %s", name, prev),
+				})
+				continue
+			}
+			defined[r.library][name] = filename
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
 }
 
 // 'include' needs to be defined in the scope of a 'tpl' templates as
@@ -187,6 +603,9 @@ func sortTemplates(tpls map[string]renderable) []string {
 		i++
 	}
 	sort.Sort(sort.Reverse(byPathLen(keys)))
+	sort.SliceStable(keys, func(i, j int) bool {
+		return tpls[keys[i]].library && !tpls[keys[j]].library
+	})
 	return keys
 }
 
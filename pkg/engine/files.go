@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"encoding/base64"
+	"path"
+	"strings"
+
+	"yaml-template-cli/pkg/fileutil"
+)
+
+// files is the .Files object of the templates: the files of the input
+// directory that are not templates, keyed by their slash separated path.
+type files map[string][]byte
+
+// newFiles returns the files object of the files of a templates.Template.
+func newFiles(from map[string][]byte) files {
+	f := make(files, len(from))
+	for name, data := range from {
+		f[name] = data
+	}
+	return f
+}
+
+// GetBytes gets a file by path. It returns nil when the file does not exist.
+//
+// This is intended to be accessed from within a templates, so a missed key
+// returns an empty []byte.
+func (f files) GetBytes(name string) []byte {
+	if v, ok := f[name]; ok {
+		return v
+	}
+	return []byte{}
+}
+
+// Get returns a string representation of the given file.
+//
+// Fetch the contents of a file as a string. It is designed to be called in a
+// templates.
+//
+//	{{.Files.Get "foo"}}
+func (f files) Get(name string) string {
+	return string(f.GetBytes(name))
+}
+
+// Glob takes a glob pattern and returns another files object only containing
+// matched files. The pattern is a .gitignore style pattern anchored to the
+// input directory, so ** matches any number of directories.
+//
+//	{{ range $name, $content := .Files.Glob "foo/**" }}
+//	{{ $name }}: |
+//	{{ $content | toString | indent 4 }}{{ end }}
+func (f files) Glob(pattern string) files {
+	m, err := fileutil.NewMatcher([]string{"/" + strings.TrimPrefix(pattern, "/")})
+	if err != nil {
+		return files{}
+	}
+	nf := make(files)
+	for name, contents := range f {
+		if m.Match(name, false) {
+			nf[name] = contents
+		}
+	}
+	return nf
+}
+
+// AsConfig turns a files group and flattens it to a YAML map suitable for
+// including in the 'data' section of a Kubernetes ConfigMap definition.
+// Duplicate keys will be overwritten, so be aware that your file names
+// (regardless of path) should be unique.
+//
+//	data:
+//	{{ (.Files.Glob "config/**").AsConfig | indent 4 }}
+func (f files) AsConfig() string {
+	if len(f) == 0 {
+		return ""
+	}
+	m := make(map[string]string, len(f))
+	for k, v := range f {
+		m[path.Base(k)] = string(v)
+	}
+	return toYAML(m)
+}
+
+// AsSecrets returns the base64-encoded value of a files object suitable for
+// including in the 'data' section of a Kubernetes Secret definition.
+// Duplicate keys will be overwritten, so be aware that your file names
+// (regardless of path) should be unique.
+//
+//	data:
+//	{{ (.Files.Glob "secrets/*").AsSecrets | indent 4 }}
+func (f files) AsSecrets() string {
+	if len(f) == 0 {
+		return ""
+	}
+	m := make(map[string]string, len(f))
+	for k, v := range f {
+		m[path.Base(k)] = base64.StdEncoding.EncodeToString(v)
+	}
+	return toYAML(m)
+}
+
+// Lines returns each line of a named file (split by "\n") as a slice, so it
+// can be ranged over in your templates.
+//
+//	{{ range .Files.Lines "foo/bar.html" }}
+//	{{ . }}{{ end }}
+func (f files) Lines(path string) []string {
+	if f == nil || f[path] == nil {
+		return []string{}
+	}
+	s := string(f[path])
+	if s != "" && s[len(s)-1] == '\n' {
+		s = s[:len(s)-1]
+	}
+	return strings.Split(s, "\n")
+}
@@ -19,6 +19,8 @@ package engine
 import (
 	"bytes"
 	"encoding/json"
+	"os"
+	"path"
 	"strings"
 	"text/template"
 
@@ -37,6 +39,7 @@ import (
 //
 //   - "include"
 //   - "tpl"
+//   - "env" and "expandenv", only when Engine.AllowEnv is set
 //
 // These are late-bound in Engine.Render().  The
 // version included in the FuncMap is a placeholder.
@@ -75,6 +78,41 @@ func funcMap() template.FuncMap {
 	return f
 }
 
+// envFuncs returns the sprig "env" and "expandenv" functions restricted to the
+// environment variables matching the allow-list. Other variables read as
+// empty strings.
+func envFuncs(allow []string) template.FuncMap {
+	getenv := func(name string) string {
+		if !envAllowed(allow, name) {
+			return ""
+		}
+		return os.Getenv(name)
+	}
+	return template.FuncMap{
+		"env": getenv,
+		"expandenv": func(s string) string {
+			return os.Expand(s, getenv)
+		},
+	}
+}
+
+// envAllowed reports whether name matches an entry of the allow-list. Entries
+// holding glob characters are matched as patterns, others as prefixes.
+func envAllowed(allow []string, name string) bool {
+	for _, pattern := range allow {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
 // toYAML takes an interface, marshals it to yaml, and returns a string. It will
 // always return a string, even on marshal error (empty string).
 //
@@ -1,11 +1,15 @@
 package fileutil
 
 import (
-	"github.com/imdario/mergo"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"sigs.k8s.io/yaml"
+	"strings"
+	"yaml-template-cli/pkg/getter"
 	"yaml-template-cli/pkg/templates"
 )
 
@@ -21,11 +25,92 @@ func ReadFile(filename string) ([]byte, error) {
 	return data, nil
 }
 
-func WriteFile(filename string, data []byte, perm os.FileMode) error {
-	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+// WriteFile
+// 写入文件，必要时创建父目录，已存在的文件也会被设置为 perm 权限
+// 内容先写入同目录下已设置为 perm 权限的临时文件，再重命名覆盖目标文件，
+// 因此内容不会以旧文件的权限出现，也不会出现只写了一部分的文件
+func WriteFile(filename string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	return os.WriteFile(filename, data, perm)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// WriteFileIfChanged
+// 只有当文件内容发生变化时才写入，保持未变化文件的修改时间不变（权限不同时只修改权限）
+// 返回文件内容是否被写入
+func WriteFileIfChanged(filename string, data []byte, perm os.FileMode) (bool, error) {
+	if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, err
+		}
+		if info.Mode().Perm() != perm {
+			return false, os.Chmod(filename, perm)
+		}
+		return false, nil
+	}
+	return true, WriteFile(filename, data, perm)
+}
+
+// CopyDir
+// 递归复制目录，保留文件的权限和修改时间，符号链接按链接本身复制（不复制其指向的内容）
+func CopyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("cannot copy %s: not a regular file", name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
 }
 
 func ReadTemplateFiles(tplFiles, valuesFiles []string) (*templates.Template, error) {
@@ -39,10 +124,15 @@ func ReadTemplateFiles(tplFiles, valuesFiles []string) (*templates.Template, err
 		if err != nil {
 			return nil, err
 		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
 		// 添加到模板中
 		tpls.Templates = append(tpls.Templates, templates.File{
 			Name: file,
 			Data: data,
+			Mode: info.Mode().Perm(),
 		})
 	}
 	values, err := ReadValuesFiles(valuesFiles)
@@ -54,56 +144,232 @@ func ReadTemplateFiles(tplFiles, valuesFiles []string) (*templates.Template, err
 }
 
 func ReadValuesFiles(files []string) (templates.Values, error) {
-	values := map[string]interface{}{}
+	return ReadValuesFilesWithFormat(files, "")
+}
+
+// ReadValuesFilesWithFormat
+// 按顺序读取并合并values文件，后面的文件覆盖前面的文件
+// format 为空时根据文件扩展名选择解析格式（yaml、json、toml、env、properties）
+func ReadValuesFilesWithFormat(files []string, format string) (templates.Values, error) {
+	return ReadValuesSources(files, format, getter.New(getter.DefaultTimeout), templates.MergeOptions{Strategy: templates.MergeReplace})
+}
+
+// ReadValuesSources
+// 与 ReadValuesFilesWithFormat 相同，但 sources 还可以是通配符（按排序展开）、
+// 表示标准输入的 "-" 以及 file:// 和 http(s):// 地址，通过 g 读取
+// 多个values按 merge 指定的策略合并
+func ReadValuesSources(sources []string, format string, g *getter.Getter, merge templates.MergeOptions) (templates.Values, error) {
+	read, err := GetValuesSources(sources, format, g)
+	if err != nil {
+		return nil, err
+	}
+	return MergeValuesSources(read, merge)
+}
+
+// ValuesSource
+// 读取到的一个values文件的内容
+type ValuesSource struct {
+	// Name 展开通配符后的来源，例如文件路径、"-" 或地址
+	Name string
+	// Format 解析该文件使用的格式
+	Format string
+	Data   []byte
+}
+
+// GetValuesSources
+// 展开 sources 中的通配符，并通过 g 按顺序读取每个values文件的内容，不解析
+// format 为空时根据文件扩展名选择解析格式
+func GetValuesSources(sources []string, format string, g *getter.Getter) ([]ValuesSource, error) {
+	files, err := getter.Expand(sources)
+	if err != nil {
+		return nil, err
+	}
+	read := make([]ValuesSource, 0, len(files))
 	for _, file := range files {
 		// 读取文件内容
-		data, err := ReadFile(file)
+		data, err := g.Get(file)
 		if err != nil {
 			return nil, err
 		}
-		// 解析文件内容为YAML
-		yamlData := map[string]interface{}{}
-		if err := yaml.Unmarshal(data, &yamlData); err != nil {
-			return nil, err
+		fileFormat := format
+		if fileFormat == "" {
+			fileFormat = templates.FormatFromFilename(getter.Filename(file))
 		}
-		// 合并到values
-		err = mergo.Merge(&values, yamlData, mergo.WithOverride)
+		read = append(read, ValuesSource{Name: file, Format: fileFormat, Data: data})
+	}
+	return read, nil
+}
+
+// MergeValuesSources
+// 按顺序解析并合并 GetValuesSources 读取的values，后面的覆盖前面的
+func MergeValuesSources(sources []ValuesSource, merge templates.MergeOptions) (templates.Values, error) {
+	values := map[string]interface{}{}
+	for _, source := range sources {
+		// 解析文件内容
+		fileValues, err := templates.ParseValues(source.Data, source.Format)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "failed to parse %s", source.Name)
 		}
+		// 合并到values
+		values = templates.MergeValues(values, fileValues, merge)
 	}
 	return values, nil
 }
 
-// ListAllFilesWithExt
-// 返回指定路径下所有指定扩展名的文件
-// 暂不支持递归遍历子目录
-func ListAllFilesWithExt(path string, exts []string) ([]string, error) {
-	var tplFiles []string
-	// 读取文件夹下的所有文件
-	files, err := os.ReadDir(path)
+// TemplateSuffixes 可选的模板文件后缀，输出时会被去掉，例如 nginx.conf.tpl 输出为 nginx.conf
+var TemplateSuffixes = []string{".tpl", ".gotmpl"}
+
+// TrimTemplateSuffix
+// 去掉文件名的模板后缀（.tpl、.gotmpl），没有该后缀时原样返回
+func TrimTemplateSuffix(name string) string {
+	for _, suffix := range TemplateSuffixes {
+		if trimmed := strings.TrimSuffix(name, suffix); trimmed != name && trimmed != "" && !strings.HasSuffix(trimmed, "/") {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// ListTemplateFiles
+// 递归返回输入目录下的模板文件，结果按路径排序
+// 相对于 dir 的路径本身或去掉模板后缀后匹配 include 的文件才是模板，例如 *.tpl 和 *.yaml 都匹配 a.yaml.tpl；
+// 匹配 exclude 的文件和目录会被跳过，skipPaths 中的目录和文件（例如位于输入目录内的输出目录或输出文件）也会被跳过
+func ListTemplateFiles(dir string, include, exclude *Matcher, skipPaths ...string) ([]string, error) {
+	return listFiles(dir, exclude, skipPaths, func(rel string) bool {
+		return isTemplate(include, rel)
+	})
+}
+
+// ReadDataFiles
+// 读取输入目录下除模板以外的文件，即模板中的 .Files，key 为以 / 分隔的相对路径
+// include、exclude 和 skipPaths 与 ListTemplateFiles 相同，隐藏文件和目录会被跳过
+func ReadDataFiles(dir string, include, exclude *Matcher, skipPaths ...string) (map[string][]byte, error) {
+	names, err := listFiles(dir, exclude, skipPaths, func(rel string) bool {
+		return !isTemplate(include, rel) && !hidden(rel)
+	})
 	if err != nil {
 		return nil, err
 	}
-	// 遍历文件
-	for _, file := range files {
-		// 判断是否为文件
-		if file.IsDir() {
+	files := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.ToSlash(rel)] = data
+	}
+	return files, nil
+}
+
+// isTemplate
+// 判断相对路径 rel 本身或去掉模板后缀后是否匹配 include
+func isTemplate(include *Matcher, rel string) bool {
+	return include.Match(rel, false) || include.Match(TrimTemplateSuffix(rel), false)
+}
+
+// hidden
+// 判断以 / 分隔的相对路径中是否有以 . 开头的文件或目录
+func hidden(rel string) bool {
+	return strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.")
+}
+
+// listFiles
+// 递归返回 dir 下相对路径满足 keep 的文件，结果按路径排序
+// 匹配 exclude 的文件和目录以及 skipPaths 中的目录和文件会被跳过
+func listFiles(dir string, exclude *Matcher, skipPaths []string, keep func(rel string) bool) ([]string, error) {
+	var files []string
+	skip := make(map[string]bool, len(skipPaths))
+	for _, p := range skipPaths {
+		if p == "" {
 			continue
 		}
-		// 判断扩展名是否符合条件
-		if contains(exts, filepath.Ext(file.Name())) {
-			tplFiles = append(tplFiles, filepath.Join(path, file.Name()))
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		skip[abs] = true
+	}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if skip[abs] || exclude.Match(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skip[abs] || exclude.Match(rel, false) {
+			return nil
+		}
+		if keep(rel) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ListAllFiles
+// 递归返回指定路径下的所有文件，结果按路径排序
+// 路径不存在时返回空列表
+func ListAllFiles(path string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == path && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, name)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return tplFiles, nil
+	return files, nil
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// OutputPaths
+// 计算每个模板文件在输出目录下的路径，保留其相对于输入目录的目录结构
+// 例如 templates/app/deploy.yaml 会输出到 out/app/deploy.yaml，模板后缀会被去掉
+// 如果两个模板会输出到同一个路径，返回错误
+func OutputPaths(inputDir, outputDir string, files []string) (map[string]string, error) {
+	paths := make(map[string]string, len(files))
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(inputDir, file)
+		if err != nil {
+			return nil, err
+		}
+		out := filepath.Join(outputDir, TrimTemplateSuffix(rel))
+		if prev, ok := sources[out]; ok {
+			return nil, fmt.Errorf("templates %s and %s both render to %s", prev, file, out)
 		}
+		sources[out] = file
+		paths[file] = out
 	}
-	return false
+	return paths, nil
 }
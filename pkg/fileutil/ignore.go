@@ -0,0 +1,171 @@
+package fileutil
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// IgnoreFileName 输入目录中列出不作为模板的文件的文件名，语法与 .gitignore 相同
+const IgnoreFileName = ".templateignore"
+
+// Matcher
+// 按 .gitignore 的语法匹配相对路径：
+// 不含 / 的模式匹配任意层级的文件名，含 / 的模式相对于根目录匹配，
+// 以 / 结尾的模式只匹配目录，以 ! 开头的模式重新包含之前排除的路径，
+// * 和 ? 不匹配 /，** 匹配任意层级的目录。后面的模式优先
+type Matcher struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewMatcher
+// 编译模式列表，空行和以 # 开头的行会被忽略
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, p := range patterns {
+		p = strings.TrimRight(p, " \t\r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		var pat pattern
+		if strings.HasPrefix(p, "!") {
+			pat.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			pat.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		re, err := globRegexp(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", p)
+		}
+		pat.re = re
+		m.patterns = append(m.patterns, pat)
+	}
+	return m, nil
+}
+
+// ParseIgnore
+// 解析 .templateignore 文件的内容，每行一个模式
+func ParseIgnore(data []byte) (*Matcher, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewMatcher(patterns)
+}
+
+// Match
+// 判断以 / 分隔的相对路径 name 是否被模式匹配，isDir 表示 name 是否为目录
+// nil 的 Matcher 不匹配任何路径
+func (m *Matcher) Match(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	matched := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(name) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// Add
+// 把 other 的模式追加到 m 之后，other 的模式优先
+func (m *Matcher) Add(other *Matcher) {
+	if other != nil {
+		m.patterns = append(m.patterns, other.patterns...)
+	}
+}
+
+// globRegexp 把 .gitignore 模式转换为匹配完整相对路径的正则表达式
+func globRegexp(p string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if _, err := path.Match(strings.ReplaceAll(p, "**", "*"), ""); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			var class string
+			class, i = classRegexp(p, i)
+			b.WriteString(class)
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// classRegexp 把从 p[i] 的 [ 开始的字符集合转换为正则表达式，返回结束的 ] 的位置
+// 以 ! 或 ^ 开头表示取反，\ 转义下一个字符（例如 [\]] 匹配 ]），集合不匹配 /
+// p 已经通过 path.Match 检查，集合一定有结束的 ]
+func classRegexp(p string, i int) (string, int) {
+	var b strings.Builder
+	b.WriteString("[")
+	i++
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		b.WriteString("^/")
+		i++
+	}
+	for i < len(p) && p[i] != ']' {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+			if p[i] == '-' {
+				b.WriteString(`\-`)
+				i++
+				continue
+			}
+		} else if p[i] == '-' {
+			b.WriteByte('-')
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(p[i:])
+		b.WriteString(regexp.QuoteMeta(string(r)))
+		i += size
+	}
+	b.WriteString("]")
+	return b.String(), i
+}
@@ -0,0 +1,90 @@
+package fileutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		patterns string
+		name     string
+		isDir    bool
+		want     bool
+	}{
+		// Patterns without a slash match at any depth.
+		{"*.tpl", "a.tpl", false, true},
+		{"*.tpl", "x/y/a.tpl", false, true},
+		{"*.tpl", "a.tpl.bak", false, false},
+		{"a?.yaml", "ab.yaml", false, true},
+		{"a?.yaml", "a/.yaml", false, false},
+		// A slash anchors the pattern to the root.
+		{"/a.yaml", "a.yaml", false, true},
+		{"/a.yaml", "x/a.yaml", false, false},
+		{"x/*.yaml", "x/a.yaml", false, true},
+		{"x/*.yaml", "y/x/a.yaml", false, false},
+		{"x/*.yaml", "x/y/a.yaml", false, false},
+		// ** matches any number of directories.
+		{"**/a.yaml", "a.yaml", false, true},
+		{"**/a.yaml", "x/y/a.yaml", false, true},
+		{"x/**/a.yaml", "x/a.yaml", false, true},
+		{"x/**/a.yaml", "x/y/z/a.yaml", false, true},
+		{"x/**/a.yaml", "y/x/a.yaml", false, false},
+		{"x/**", "x/y/a.yaml", false, true},
+		{"x/**", "y/a.yaml", false, false},
+		// Dir-only patterns.
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "x/build", true, true},
+		// Later patterns win, ! re-includes.
+		{"*.yaml\n!keep.yaml", "keep.yaml", false, false},
+		{"*.yaml\n!keep.yaml", "drop.yaml", false, true},
+		{"!keep.yaml\n*.yaml", "keep.yaml", false, true},
+		// Comments and blank lines.
+		{"# *.yaml\n\n", "a.yaml", false, false},
+		// Character classes.
+		{"[ab].yaml", "a.yaml", false, true},
+		{"[ab].yaml", "c.yaml", false, false},
+		{"[a-c].yaml", "b.yaml", false, true},
+		{"[!a].yaml", "a.yaml", false, false},
+		{"[!a].yaml", "b.yaml", false, true},
+		{"[^a].yaml", "b.yaml", false, true},
+		{"x[!a]y", "x/y", false, false},
+		{`[\]].yaml`, "].yaml", false, true},
+		{`[\]].yaml`, `\.yaml`, false, false},
+		{`[\-a].yaml`, "-.yaml", false, true},
+		{`[\-a].yaml`, "b.yaml", false, false},
+		{"[.].yaml", "a.yaml", false, false},
+		{"[é].yaml", "é.yaml", false, true},
+		// Escapes.
+		{`\*.yaml`, "*.yaml", false, true},
+		{`\*.yaml`, "a.yaml", false, false},
+		{`\!a.yaml`, "!a.yaml", false, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseIgnore([]byte(tt.patterns))
+		if err != nil {
+			t.Errorf("ParseIgnore(%q): %v", tt.patterns, err)
+			continue
+		}
+		if got := m.Match(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("%q matching %q (dir: %t) = %t, want %t", tt.patterns, tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestMatcherInvalid(t *testing.T) {
+	for _, p := range []string{"[a", "a[", `[\`} {
+		_, err := NewMatcher([]string{p})
+		if err == nil || !strings.Contains(err.Error(), "syntax error in pattern") {
+			t.Errorf("NewMatcher(%q) = %v, want a pattern syntax error", p, err)
+		}
+	}
+}
+
+func TestMatcherNil(t *testing.T) {
+	var m *Matcher
+	if m.Match("a.yaml", false) {
+		t.Error("a nil Matcher matched")
+	}
+}
@@ -0,0 +1,166 @@
+package getter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stdin is the source name that reads values from the standard input.
+const Stdin = "-"
+
+// DefaultTimeout bounds the time spent fetching a remote source.
+const DefaultTimeout = 30 * time.Second
+
+// Getter reads values sources: local paths, "-" for stdin, file:// URLs and
+// http(s):// URLs.
+type Getter struct {
+	// Client fetches the http(s) sources. Its Timeout bounds every request.
+	Client *http.Client
+	// CacheDir keeps a copy of every remote source fetched. The copy is used
+	// when the source can't be fetched, or right away when Offline is set.
+	CacheDir string
+	// Offline never fetches remote sources, it reads them from CacheDir.
+	Offline bool
+	// Stdin is read for the "-" source.
+	Stdin io.Reader
+}
+
+// New returns a Getter fetching remote sources with the given timeout.
+func New(timeout time.Duration) *Getter {
+	return &Getter{
+		Client: &http.Client{Timeout: timeout},
+		Stdin:  os.Stdin,
+	}
+}
+
+// IsRemote reports whether source is an URL rather than a local path.
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "file://")
+}
+
+// IsGlob reports whether source is a pattern matching several local paths.
+func IsGlob(source string) bool {
+	return !IsRemote(source) && strings.ContainsAny(source, "*?[")
+}
+
+// Expand replaces the glob patterns of sources by the paths they match, in
+// sorted order. A pattern that matches nothing is an error, so a typo doesn't
+// silently drop values.
+func Expand(sources []string) ([]string, error) {
+	var expanded []string
+	for _, source := range sources {
+		if !IsGlob(source) {
+			expanded = append(expanded, source)
+			continue
+		}
+		matches, err := filepath.Glob(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid values pattern %s", source)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no values files match %s", source)
+		}
+		sort.Strings(matches)
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// Filename returns the path part of source, whose extension tells the format
+// of the values.
+func Filename(source string) string {
+	if !IsRemote(source) {
+		return source
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	return u.Path
+}
+
+// Get returns the content of source.
+func (g *Getter) Get(source string) ([]byte, error) {
+	switch {
+	case source == Stdin:
+		return io.ReadAll(g.Stdin)
+	case strings.HasPrefix(source, "file://"):
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.FromSlash(u.Path))
+	case IsRemote(source):
+		return g.getHTTP(source)
+	}
+	return os.ReadFile(source)
+}
+
+func (g *Getter) getHTTP(source string) ([]byte, error) {
+	if g.Offline {
+		if g.CacheDir == "" {
+			return nil, errors.Errorf("cannot read %s offline without a cache dir", source)
+		}
+		data, err := os.ReadFile(g.cachePath(source))
+		if err != nil {
+			return nil, errors.Errorf("%s is not in the cache dir %s", source, g.CacheDir)
+		}
+		return data, nil
+	}
+	data, err := g.fetch(source)
+	if err != nil {
+		if g.CacheDir != "" {
+			if cached, cacheErr := os.ReadFile(g.cachePath(source)); cacheErr == nil {
+				return cached, nil
+			}
+		}
+		return nil, err
+	}
+	if g.CacheDir != "" {
+		if err := os.MkdirAll(g.CacheDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(g.cachePath(source), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (g *Getter) fetch(source string) ([]byte, error) {
+	client := g.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", source)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", source, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", source)
+	}
+	return data, nil
+}
+
+// cachePath returns the file of the cache dir holding a copy of source. The
+// extension is kept so the format of the copy is the same as the source's.
+func (g *Getter) cachePath(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(g.CacheDir, hex.EncodeToString(sum[:])+filepath.Ext(Filename(source)))
+}
@@ -0,0 +1,123 @@
+package getter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer serves body at every path, or status when it is not 200, and
+// counts the requests.
+func newServer(t *testing.T, status *int32, body string) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if code := int(atomic.LoadInt32(status)); code != http.StatusOK {
+			http.Error(w, "unavailable", code)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestGetHTTP(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv, _ := newServer(t, &status, "a: 1\n")
+	data, err := New(time.Second).Get(srv.URL + "/values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a: 1\n" {
+		t.Errorf("got %q, want %q", data, "a: 1\n")
+	}
+}
+
+func TestGetHTTPStatus(t *testing.T) {
+	status := int32(http.StatusNotFound)
+	srv, _ := newServer(t, &status, "")
+	_, err := New(time.Second).Get(srv.URL + "/values.yaml")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got error %v, want a 404 error", err)
+	}
+}
+
+func TestGetHTTPTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	start := time.Now()
+	_, err := New(50 * time.Millisecond).Get(srv.URL + "/values.yaml")
+	if err == nil {
+		t.Fatal("got no error from a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the timeout was not applied, the fetch took %s", elapsed)
+	}
+}
+
+func TestGetHTTPCacheFallback(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv, _ := newServer(t, &status, "a: 1\n")
+	g := New(time.Second)
+	g.CacheDir = t.TempDir()
+	source := srv.URL + "/values.yaml"
+	if _, err := g.Get(source); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	data, err := g.Get(source)
+	if err != nil {
+		t.Fatalf("the cached copy was not used: %v", err)
+	}
+	if string(data) != "a: 1\n" {
+		t.Errorf("got %q, want the cached %q", data, "a: 1\n")
+	}
+
+	if _, err := g.Get(srv.URL + "/other.yaml"); err == nil {
+		t.Error("got no error for a source that is neither fetched nor cached")
+	}
+}
+
+func TestGetHTTPOffline(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv, requests := newServer(t, &status, "a: 1\n")
+	g := New(time.Second)
+	g.CacheDir = t.TempDir()
+	source := srv.URL + "/values.yaml"
+	if _, err := g.Get(source); err != nil {
+		t.Fatal(err)
+	}
+
+	g.Offline = true
+	data, err := g.Get(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a: 1\n" {
+		t.Errorf("got %q, want the cached %q", data, "a: 1\n")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("got %d requests, want only the first one", n)
+	}
+	if _, err := g.Get(srv.URL + "/other.yaml"); err == nil {
+		t.Error("got no error offline for a source that is not cached")
+	}
+
+	g.CacheDir = ""
+	if _, err := g.Get(source); err == nil {
+		t.Error("got no error offline without a cache dir")
+	}
+}
@@ -0,0 +1,296 @@
+package render
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"yaml-template-cli/pkg/engine"
+	"yaml-template-cli/pkg/fileutil"
+	"yaml-template-cli/pkg/getter"
+	"yaml-template-cli/pkg/templates"
+	"yaml-template-cli/pkg/yamlutil"
+)
+
+// AuditResult compares the values defined with the values the templates
+// read.
+type AuditResult struct {
+	// Templates is the number of templates audited.
+	Templates int
+	// Unused are the values defined that no template reads, with where they
+	// are defined.
+	Unused []KeyReport
+	// Undefined are the values read that nothing defines, with where they
+	// are read.
+	Undefined []KeyReport
+}
+
+// KeyReport is a values path with its locations.
+type KeyReport struct {
+	Path      string
+	Locations []string
+}
+
+func (k KeyReport) String() string {
+	if len(k.Locations) == 0 {
+		return k.Path
+	}
+	return fmt.Sprintf("%s (%s)", k.Path, strings.Join(k.Locations, ", "))
+}
+
+// Audit finds the values defined but never read and the values read but
+// never defined. Values that are only tested, e.g. '{{ if .Values.a }}', or
+// given a default are not reported as undefined. The values read are found
+// by walking the templates: a value read through something only known at
+// render time, e.g. 'index .Values.a $key', counts as reading all of its
+// parent, and a template reading the whole values, e.g. 'toYaml .Values',
+// uses every value.
+func (r *Renderer) Audit() (*AuditResult, error) {
+	tpls, _, sources, err := r.loadSources()
+	if err != nil {
+		return nil, err
+	}
+	reads, err := r.engine(false).Reads(tpls)
+	if err != nil {
+		return nil, err
+	}
+	// Reads only walks the templates that are executed, not the libraries
+	// and the _ partials.
+	result := &AuditResult{Templates: len(reads)}
+	matrix := map[string]string{}
+	for _, file := range tpls.Templates {
+		if file.Matrix && !file.Library {
+			matrix[file.Name] = file.MatrixPath
+		}
+	}
+
+	// the values read, with the strongest way they are read
+	modes := map[string]engine.ReadMode{}
+	// the values read where a missing value is not expected
+	readAt := map[string][]string{}
+	record := func(path string, mode engine.ReadMode, location string, optional bool) {
+		if modes[path] != engine.ReadWhole {
+			modes[path] = mode
+		}
+		if !optional && !contains(readAt[path], location) {
+			readAt[path] = append(readAt[path], location)
+		}
+	}
+	for filename, fileReads := range reads {
+		matrixPath, isMatrix := matrix[filename]
+		if isMatrix {
+			record(matrixPath, engine.ReadWhole, filename, false)
+		}
+		for _, read := range fileReads {
+			if path, ok := valuesPath(read.Path, isMatrix, r.opts.FlatValues); ok {
+				record(path, read.Mode, read.Location, read.Optional)
+			}
+		}
+	}
+
+	defined := r.definitions(sources)
+	if modes[""] != engine.ReadWhole {
+		for _, path := range leafPaths(tpls.Values, "") {
+			if !used(path, modes) {
+				result.Unused = append(result.Unused, KeyReport{Path: path, Locations: defined[path]})
+			}
+		}
+	}
+	for path, locations := range readAt {
+		if path != "" && !isDefined(tpls.Values, path) {
+			sort.Strings(locations)
+			result.Undefined = append(result.Undefined, KeyReport{Path: path, Locations: locations})
+		}
+	}
+	sort.Slice(result.Undefined, func(i, j int) bool { return result.Undefined[i].Path < result.Undefined[j].Path })
+	return result, nil
+}
+
+// valuesPath turns a path read in the data of a template into a values path.
+// Only what is under .Values is a value. With flat values, the values are the
+// root of the data instead, next to the template information; matrix
+// templates also get their item and index, and the values under .Values.
+// Paths are joined by templates.JoinKeys.
+func valuesPath(path string, matrix, flat bool) (string, bool) {
+	var first, rest string
+	if keys := templates.SplitKeys(path); len(keys) > 0 {
+		first, rest = keys[0], templates.JoinKeys(keys[1:]...)
+	}
+	if !flat {
+		switch {
+		case first == "Values":
+			return rest, true
+		case path == "":
+			// the values and more: the values are read whole
+			return "", true
+		}
+		return "", false
+	}
+	switch {
+	case first == "Template":
+		return "", false
+	case matrix && (first == "Item" || first == "Index"):
+		return "", false
+	case matrix && first == "Values":
+		return rest, true
+	case matrix && path == "":
+		// the values and more: the values are read whole
+		return "", true
+	}
+	return path, true
+}
+
+// used tells whether a values path is read, by itself, through one of its
+// parents read whole, or through what is below it.
+func used(path string, modes map[string]engine.ReadMode) bool {
+	if _, ok := modes[path]; ok {
+		return true
+	}
+	keys := templates.SplitKeys(path)
+	for read, mode := range modes {
+		readKeys := templates.SplitKeys(read)
+		if mode == engine.ReadWhole && hasPrefix(keys, readKeys) {
+			return true
+		}
+		if hasPrefix(readKeys, keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefix tells whether the keys of prefix start the keys of path.
+func hasPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, key := range prefix {
+		if path[i] != key {
+			return false
+		}
+	}
+	return true
+}
+
+// isDefined tells whether a values path exists. A path going through a
+// value that is not a map, e.g. into a list, can't be checked and counts as
+// defined.
+func isDefined(values templates.Values, path string) bool {
+	var v interface{} = map[string]interface{}(values)
+	for _, key := range templates.SplitKeys(path) {
+		var m map[string]interface{}
+		switch t := v.(type) {
+		case map[string]interface{}:
+			m = t
+		case templates.Values:
+			m = t
+		default:
+			return true
+		}
+		if v = m[key]; v == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// leafPaths returns the sorted paths of the values that are not maps, and
+// of the empty maps.
+func leafPaths(v interface{}, prefix string) []string {
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m = t
+	case templates.Values:
+		m = t
+	}
+	if len(m) == 0 {
+		if prefix == "" {
+			return nil
+		}
+		return []string{prefix}
+	}
+	var paths []string
+	for key, val := range m {
+		path := templates.JoinKeys(key)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		paths = append(paths, leafPaths(val, path)...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// definitions returns where every values path is defined: the lines of the
+// YAML and JSON values sources, the other values sources, the environment and
+// the overrides. The sources are the ones the values were loaded from, so
+// they are not read again.
+func (r *Renderer) definitions(sources []fileutil.ValuesSource) map[string][]string {
+	locations := map[string][]string{}
+	add := func(path, location string) {
+		locations[path] = append(locations[path], location)
+	}
+	for _, source := range sources {
+		name := source.Name
+		if name == getter.Stdin {
+			name = "stdin"
+		}
+		if source.Format == templates.FormatYAML || source.Format == templates.FormatJSON {
+			if lines, err := yamlutil.KeyLines(source.Data); err == nil {
+				for path, line := range lines {
+					add(path, fmt.Sprintf("%s:%d", name, line))
+				}
+				continue
+			}
+		}
+		if fileValues, err := templates.ParseValues(source.Data, source.Format); err == nil {
+			for _, path := range allPaths(fileValues, "") {
+				add(path, name)
+			}
+		}
+	}
+	if r.opts.EnvValuesPrefix != "" {
+		environ := r.opts.Environ
+		if environ == nil {
+			environ = os.Environ()
+		}
+		for _, path := range allPaths(templates.ReadEnvValues(r.opts.EnvValuesPrefix, environ), "") {
+			add(path, "environment")
+		}
+	}
+	for _, path := range allPaths(r.opts.Overrides, "") {
+		add(path, "--set")
+	}
+	return locations
+}
+
+// allPaths returns the paths of all the values, maps included.
+func allPaths(v interface{}, prefix string) []string {
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m = t
+	case templates.Values:
+		m = t
+	}
+	var paths []string
+	for key, val := range m {
+		path := templates.JoinKeys(key)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		paths = append(append(paths, path), allPaths(val, path)...)
+	}
+	return paths
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
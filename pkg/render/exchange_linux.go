@@ -0,0 +1,8 @@
+package render
+
+import "golang.org/x/sys/unix"
+
+// exchange atomically swaps the paths a and b, which must both exist.
+func exchange(a, b string) error {
+	return unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+}
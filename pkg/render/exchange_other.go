@@ -0,0 +1,10 @@
+//go:build !linux
+
+package render
+
+import "errors"
+
+// exchange is only supported on Linux, swapDir falls back to two renames.
+func exchange(a, b string) error {
+	return errors.ErrUnsupported
+}
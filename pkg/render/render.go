@@ -0,0 +1,698 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"yaml-template-cli/pkg/engine"
+	"yaml-template-cli/pkg/fileutil"
+	"yaml-template-cli/pkg/getter"
+	"yaml-template-cli/pkg/templates"
+	"yaml-template-cli/pkg/yamlutil"
+)
+
+// DefaultInclude are the patterns of the template files read from the input
+// directory when Options.Include is empty.
+var DefaultInclude = []string{"*.yaml", "*.yml"}
+
+// Options configures a Renderer. The zero value of every field is usable.
+type Options struct {
+	// InputDir is the directory holding the templates. It is walked
+	// recursively and its layout is kept in the output.
+	InputDir string
+	// Templates are rendered instead of the files of InputDir when set,
+	// e.g. a single template read from stdin.
+	Templates []templates.File
+	// OutputDir is skipped when walking InputDir, so a previous render
+	// located inside the input directory is not read back as templates.
+	OutputDir string
+	// Include are the .gitignore style patterns of the files of InputDir
+	// that are templates, DefaultInclude when empty. They are matched with
+	// and without the .tpl or .gotmpl suffix, which is dropped from the
+	// output name.
+	Include []string
+	// Libs are directories of library templates: every file in them, except
+	// hidden ones, is parsed so its named templates can be included, but is
+	// not rendered.
+	Libs []string
+	// Exclude are the .gitignore style patterns of the files and
+	// directories of InputDir that are not templates. The patterns of the
+	// .templateignore file of InputDir are added to them.
+	Exclude []string
+
+	// ValuesFiles are the values sources, merged in order. See
+	// fileutil.ReadValuesSources for the accepted forms.
+	ValuesFiles []string
+	// ValuesFormat forces the format of the values files, which is
+	// otherwise picked from their extension.
+	ValuesFormat string
+	// Getter reads the values sources. A Getter with the default timeout is
+	// used when nil.
+	Getter *getter.Getter
+	// Merge selects how the values files and overrides are merged.
+	Merge templates.MergeOptions
+	// EnvValuesPrefix loads the environment variables with this prefix into
+	// the values, over the values files.
+	EnvValuesPrefix string
+	// Environ is the environment read by EnvValuesPrefix, os.Environ() when
+	// nil.
+	Environ []string
+	// Overrides are merged over everything else, e.g. the --set values.
+	Overrides templates.Values
+	// SchemaFile is the JSON Schema the merged values must match. When
+	// empty, the values.schema.json of InputDir is used if there is one.
+	SchemaFile string
+
+	// Strict fails the render when a template references a missing value.
+	Strict bool
+	// AllowEnv is the allow-list of the environment variables templates may
+	// read with 'env' and 'expandenv'.
+	AllowEnv []string
+	// Validate parses every YAML and JSON output, see ValidatedExts, as YAML
+	// before anything is written.
+	Validate bool
+	// Jobs is the number of templates rendered in parallel, one when zero.
+	Jobs int
+	// CacheFile keeps the outputs and their dependencies between renders,
+	// so the templates whose sources, named templates and values read did
+	// not change are not executed again. No cache is used when empty.
+	CacheFile string
+	// Matrix renders templates once per element of a values list. Every
+	// entry is "[TEMPLATE=]PATH": the templates whose path in InputDir
+	// matches the .gitignore style TEMPLATE pattern, or all templates when
+	// it is omitted, are rendered once per element of the list at the
+	// dotted values PATH. A @matrix directive in a template overrides it.
+	Matrix []string
+	// FileMode sets the permissions of every output file. When zero, an
+	// output file gets the permissions of its template. A @mode directive in
+	// a template overrides both.
+	FileMode os.FileMode
+	// FlatValues executes the templates with the values as the root of their
+	// data, as older versions did, instead of under .Values next to .Files,
+	// .Env and .Render.
+	FlatValues bool
+	// Version is the version of the tool, given to the templates as
+	// .Render.Version.
+	Version string
+
+	// Sink receives the rendered files in Run.
+	Sink Sink
+}
+
+// File is a rendered output.
+type File struct {
+	// Name is the path of the output, relative to the output directory.
+	Name string
+	// Source is the template that produced the output.
+	Source string
+	// Content is the rendered text.
+	Content string
+	// Mode is the permissions of the output file.
+	Mode os.FileMode
+}
+
+// DefaultFileMode is the permissions of the output files whose template
+// permissions are unknown, e.g. a template read from stdin.
+const DefaultFileMode os.FileMode = 0644
+
+// Result is the outcome of a render.
+type Result struct {
+	// Files are the rendered outputs, ordered by source template.
+	Files []File
+	// Values are the merged values the templates were rendered with.
+	Values templates.Values
+}
+
+// ErrInvalidOutput lists the outputs that are not valid YAML.
+type ErrInvalidOutput struct {
+	Errors []error
+}
+
+func (e ErrInvalidOutput) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LintResult is the outcome of Lint.
+type LintResult struct {
+	// Templates is the number of templates linted, libraries excluded.
+	Templates int
+	// Problems are all the problems found, in template order.
+	Problems []error
+}
+
+// Renderer renders a set of templates with its values. It holds no state
+// besides its options, so a Renderer may be used by several goroutines.
+type Renderer struct {
+	opts Options
+}
+
+// New returns a Renderer for opts.
+func New(opts Options) *Renderer {
+	return &Renderer{opts: opts}
+}
+
+// Options returns the options of the Renderer.
+func (r *Renderer) Options() Options {
+	return r.opts
+}
+
+// Render reads the templates and values and renders them, without writing
+// anything.
+func (r *Renderer) Render() (*Result, error) {
+	tpls, names, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	eng := r.engine(false)
+	if r.opts.CacheFile != "" {
+		eng.Cache = readCache(r.opts.CacheFile)
+	}
+	rendered, err := eng.Render(tpls, tpls.Values)
+	if err != nil {
+		return nil, err
+	}
+	if eng.Cache != nil {
+		if err := writeCache(r.opts.CacheFile, eng.Cache); err != nil {
+			return nil, errors.Wrapf(err, "failed to write the cache %s", r.opts.CacheFile)
+		}
+	}
+	result, err := r.result(eng, rendered, names, tpls)
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.Validate {
+		if errs := validate(result.Files); len(errs) > 0 {
+			return nil, ErrInvalidOutput{Errors: errs}
+		}
+	}
+	return result, nil
+}
+
+// Run renders the templates and writes the result to the Sink.
+func (r *Renderer) Run() (*Result, error) {
+	if r.opts.Sink == nil {
+		return nil, fmt.Errorf("no output sink")
+	}
+	result, err := r.Render()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.opts.Sink.Write(result.Files); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Lint renders every template in lint mode and returns all the problems
+// found, including YAML and JSON outputs that are not valid YAML. The error
+// is only set when the templates or values can't be read.
+func (r *Renderer) Lint() (*LintResult, error) {
+	tpls, names, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	result := &LintResult{}
+	for _, file := range tpls.Templates {
+		if !file.Library {
+			result.Templates++
+		}
+	}
+	eng := r.engine(true)
+	rendered, err := eng.Render(tpls, tpls.Values)
+	if err != nil {
+		var lintErr engine.LintError
+		if !errors.As(err, &lintErr) {
+			return nil, err
+		}
+		for _, msg := range lintErr {
+			result.Problems = append(result.Problems, msg)
+		}
+	}
+	files, err := r.result(eng, rendered, names, tpls)
+	if err != nil {
+		result.Problems = append(result.Problems, err)
+		return result, nil
+	}
+	result.Problems = append(result.Problems, validate(files.Files)...)
+	return result, nil
+}
+
+// Graph returns the dependency graph of the templates.
+func (r *Renderer) Graph() (*engine.Graph, error) {
+	tpls, _, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r.engine(false).Graph(tpls)
+}
+
+// readCache reads a cache file. A missing or unreadable cache is empty, the
+// outputs are then all rendered again.
+func readCache(filename string) *engine.Cache {
+	cache := &engine.Cache{}
+	data, err := os.ReadFile(filename)
+	if err != nil || json.Unmarshal(data, cache) != nil {
+		return &engine.Cache{}
+	}
+	return cache
+}
+
+// writeCache writes a cache file, unless it already holds the same entries.
+func writeCache(filename string, cache *engine.Cache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	_, err = fileutil.WriteFileIfChanged(filename, data, 0644)
+	return err
+}
+
+func (r *Renderer) engine(lint bool) engine.Engine {
+	return engine.Engine{
+		Strict:     r.opts.Strict,
+		LintMode:   lint,
+		AllowEnv:   r.opts.AllowEnv,
+		Jobs:       r.opts.Jobs,
+		FlatValues: r.opts.FlatValues,
+		Info: engine.Info{
+			Time:     time.Now(),
+			Version:  r.opts.Version,
+			InputDir: r.opts.InputDir,
+		},
+	}
+}
+
+// load reads the templates and values. It also returns the output name of
+// every template.
+func (r *Renderer) load() (*templates.Template, map[string]string, error) {
+	tpls, names, _, err := r.loadSources()
+	return tpls, names, err
+}
+
+// loadSources is load, also returning the values sources read.
+func (r *Renderer) loadSources() (*templates.Template, map[string]string, []fileutil.ValuesSource, error) {
+	var tpls *templates.Template
+	names := map[string]string{}
+	if r.opts.Templates != nil {
+		tpls = &templates.Template{Templates: r.opts.Templates}
+		for _, file := range r.opts.Templates {
+			names[file.Name] = file.Name
+		}
+	} else {
+		if r.opts.InputDir == "" {
+			return nil, nil, nil, fmt.Errorf("input dir is not specified")
+		}
+		include, exclude, err := r.matchers()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		files, err := fileutil.ListTemplateFiles(r.opts.InputDir, include, exclude, r.opts.OutputDir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tpls, err = fileutil.ReadTemplateFiles(files, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		names, err = fileutil.OutputPaths(r.opts.InputDir, "", files)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !r.opts.FlatValues {
+			tpls.Files, err = fileutil.ReadDataFiles(r.opts.InputDir, include, exclude, r.opts.OutputDir)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	libs, err := r.loadLibs()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tpls.Templates = append(libs, tpls.Templates...)
+	values, sources, err := r.loadValues()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tpls.Values = values
+	if err := r.resolveMatrix(tpls, names); err != nil {
+		return nil, nil, nil, err
+	}
+	return tpls, names, sources, nil
+}
+
+// loadLibs reads the library templates.
+func (r *Renderer) loadLibs() ([]templates.File, error) {
+	var libs []templates.File
+	include, err := fileutil.NewMatcher([]string{"*"})
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := fileutil.NewMatcher([]string{".*"})
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range r.opts.Libs {
+		files, err := fileutil.ListTemplateFiles(dir, include, exclude)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the library %s", dir)
+		}
+		tpls, err := fileutil.ReadTemplateFiles(files, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range tpls.Templates {
+			file.Library = true
+			libs = append(libs, file)
+		}
+	}
+	return libs, nil
+}
+
+// resolveMatrix looks up the items of the matrix templates in the values.
+func (r *Renderer) resolveMatrix(tpls *templates.Template, names map[string]string) error {
+	type rule struct {
+		match *fileutil.Matcher
+		path  string
+	}
+	var rules []rule
+	for _, entry := range r.opts.Matrix {
+		var ru rule
+		pattern, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			path = pattern
+		} else {
+			m, err := fileutil.NewMatcher([]string{pattern})
+			if err != nil {
+				return errors.Wrapf(err, "invalid matrix %q", entry)
+			}
+			ru.match = m
+		}
+		ru.path = path
+		rules = append(rules, ru)
+	}
+	for i, file := range tpls.Templates {
+		if file.Library {
+			continue
+		}
+		path, ok := templates.ParseDirectives(file.Data)[templates.DirectiveMatrix]
+		for _, ru := range rules {
+			if ok {
+				break
+			}
+			if ru.match == nil || ru.match.Match(filepath.ToSlash(names[file.Name]), false) {
+				path, ok = ru.path, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		items, err := matrixItems(tpls.Values, path)
+		if err != nil {
+			return errors.Wrapf(err, "invalid matrix of %s", file.Name)
+		}
+		tpls.Templates[i].Matrix = true
+		tpls.Templates[i].MatrixPath = strings.TrimPrefix(strings.TrimSpace(path), ".")
+		tpls.Templates[i].Items = items
+	}
+	return nil
+}
+
+// matrixItems returns the list at the dotted path of the values. A missing
+// list has no items.
+func matrixItems(values templates.Values, path string) ([]interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), ".")
+	if path == "" {
+		return nil, fmt.Errorf("empty values path")
+	}
+	v, err := values.PathValue(path)
+	if err != nil {
+		if _, tableErr := values.Table(path); tableErr == nil {
+			return nil, fmt.Errorf("%s is a map, not a list", path)
+		}
+		return []interface{}{}, nil
+	}
+	switch items := v.(type) {
+	case []interface{}:
+		return items, nil
+	case nil:
+		return []interface{}{}, nil
+	default:
+		return nil, fmt.Errorf("%s is a %T, not a list", path, v)
+	}
+}
+
+// matchers returns the include and exclude patterns of the template files.
+// The ignore and schema files of the input directory are never templates.
+func (r *Renderer) matchers() (include, exclude *fileutil.Matcher, err error) {
+	patterns := r.opts.Include
+	if len(patterns) == 0 {
+		patterns = DefaultInclude
+	}
+	if include, err = fileutil.NewMatcher(patterns); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid include pattern")
+	}
+	patterns = append([]string{"/" + fileutil.IgnoreFileName, "/" + templates.SchemaFileName}, r.opts.Exclude...)
+	if exclude, err = fileutil.NewMatcher(patterns); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid exclude pattern")
+	}
+	ignoreFile := filepath.Join(r.opts.InputDir, fileutil.IgnoreFileName)
+	data, err := os.ReadFile(ignoreFile)
+	if os.IsNotExist(err) {
+		return include, exclude, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	ignore, err := fileutil.ParseIgnore(data)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse %s", ignoreFile)
+	}
+	exclude.Add(ignore)
+	return include, exclude, nil
+}
+
+// LoadValues reads and merges the values files, applies the overrides and
+// validates the result against the schema.
+func (r *Renderer) LoadValues() (templates.Values, error) {
+	values, _, err := r.loadValues()
+	return values, err
+}
+
+// loadValues is LoadValues, also returning the values sources read.
+func (r *Renderer) loadValues() (templates.Values, []fileutil.ValuesSource, error) {
+	g := r.opts.Getter
+	if g == nil {
+		g = getter.New(getter.DefaultTimeout)
+	}
+	merge := r.opts.Merge
+	if merge.Strategy == "" {
+		merge.Strategy = templates.MergeReplace
+	}
+	sources, err := fileutil.GetValuesSources(r.opts.ValuesFiles, r.opts.ValuesFormat, g)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := fileutil.MergeValuesSources(sources, merge)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.opts.EnvValuesPrefix != "" {
+		environ := r.opts.Environ
+		if environ == nil {
+			environ = os.Environ()
+		}
+		values.MergeValues(templates.ReadEnvValues(r.opts.EnvValuesPrefix, environ), merge)
+	}
+	values.MergeValues(r.opts.Overrides, merge)
+	if err := r.validateSchema(values); err != nil {
+		return nil, nil, err
+	}
+	return values, sources, nil
+}
+
+// validateSchema checks the merged values against the schema file, or the
+// values.schema.json of the input directory if there is one.
+func (r *Renderer) validateSchema(values templates.Values) error {
+	schemaFile := r.opts.SchemaFile
+	if schemaFile == "" {
+		if r.opts.InputDir == "" {
+			return nil
+		}
+		schemaFile = filepath.Join(r.opts.InputDir, templates.SchemaFileName)
+		if _, err := os.Stat(schemaFile); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	schema, err := fileutil.ReadFile(schemaFile)
+	if err != nil {
+		return err
+	}
+	return templates.ValidateAgainstSchema(values, schema)
+}
+
+// result turns the output of the engine into a Result. The output names
+// and @output directives are rendered as templates here.
+func (r *Renderer) result(eng engine.Engine, rendered map[string]string, names map[string]string, tpls *templates.Template) (*Result, error) {
+	files := make([]templates.File, len(tpls.Templates))
+	copy(files, tpls.Templates)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	result := &Result{Files: make([]File, 0, len(rendered)), Values: tpls.Values}
+	outputs := make(map[string]string, len(rendered))
+	for _, file := range files {
+		source := file.Name
+		directives := templates.ParseDirectives(file.Data)
+		mode, err := r.fileMode(file.Mode, directives)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid @%s directive in %s", templates.DirectiveMode, source)
+		}
+		n := 1
+		if file.Matrix {
+			n = len(file.Items)
+		}
+		for i := 0; i < n; i++ {
+			key := source
+			if file.Matrix {
+				key = engine.MatrixKey(source, i)
+			}
+			content, ok := rendered[key]
+			if !ok {
+				// partials, and templates that failed in lint mode
+				continue
+			}
+			if _, ok := directives[templates.DirectiveSkipIfEmpty]; ok && strings.TrimSpace(content) == "" {
+				continue
+			}
+			data := func() templates.Values {
+				if file.Matrix {
+					return eng.MatrixContext(tpls, source, file.Items[i], i)
+				}
+				return eng.Context(tpls, source)
+			}
+			name, err := r.outputName(eng, source, names[source], directives, data)
+			if err != nil {
+				return nil, err
+			}
+			if file.Matrix && !strings.Contains(names[source], "{{") && directives[templates.DirectiveOutput] == "" {
+				name = matrixName(name, file.Items[i], i)
+			}
+			if prev, ok := outputs[name]; ok {
+				return nil, fmt.Errorf("templates %s and %s both render to %s", prev, key, name)
+			}
+			outputs[name] = key
+			result.Files = append(result.Files, File{
+				Name:    name,
+				Source:  source,
+				Content: content,
+				Mode:    mode,
+			})
+		}
+	}
+	return result, nil
+}
+
+// matrixName derives the output name of a matrix item from the name of the
+// template when the name is not a template itself: deploy.yaml becomes
+// deploy-<id>.yaml, the id being the name field of the item, the item itself
+// when it is a scalar, or its index.
+func matrixName(name string, item interface{}, index int) string {
+	id := strconv.Itoa(index)
+	switch v := item.(type) {
+	case map[string]interface{}:
+		if n, ok := v["name"]; ok && n != nil {
+			if _, isMap := n.(map[string]interface{}); !isMap {
+				id = fmt.Sprint(n)
+			}
+		}
+	case []interface{}, nil:
+	default:
+		id = fmt.Sprint(v)
+	}
+	id = strings.NewReplacer("/", "-", string(filepath.Separator), "-").Replace(id)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + id + ext
+}
+
+// outputName renders the output name of a template: its @output directive
+// if it has one, otherwise its path in the input directory. The result must
+// stay inside the output directory. A name that is a template is rendered
+// with the data returned by data, the same as the template's.
+func (r *Renderer) outputName(eng engine.Engine, source, name string, directives map[string]string, data func() templates.Values) (string, error) {
+	what := "output name"
+	if output, ok := directives[templates.DirectiveOutput]; ok {
+		name, what = output, "@"+templates.DirectiveOutput+" directive"
+	}
+	if strings.Contains(name, "{{") {
+		// The name is not linted with the template, failures are errors.
+		eng.LintMode = false
+		var err error
+		name, err = eng.RenderText(source, name, data())
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to render the %s of %s", what, source)
+		}
+	}
+	name = filepath.Clean(strings.TrimSpace(name))
+	if name == "." || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("the %s of %s is %q, which is not a path inside the output directory", what, source, name)
+	}
+	return name, nil
+}
+
+// fileMode picks the permissions of an output file: the @mode directive of
+// its template, then Options.FileMode, then the permissions of the template.
+func (r *Renderer) fileMode(tplMode os.FileMode, directives map[string]string) (os.FileMode, error) {
+	if v, ok := directives[templates.DirectiveMode]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0777 {
+			return 0, fmt.Errorf("%q is not an octal file mode", v)
+		}
+		return os.FileMode(mode), nil
+	}
+	if r.opts.FileMode != 0 {
+		return r.opts.FileMode, nil
+	}
+	if tplMode != 0 {
+		return tplMode, nil
+	}
+	return DefaultFileMode, nil
+}
+
+// ValidatedExts are the extensions of the outputs that are parsed as YAML by
+// Lint and Options.Validate. Other outputs, e.g. shell scripts, are not.
+var ValidatedExts = []string{".yaml", ".yml", ".json"}
+
+// validate parses every YAML and JSON output as YAML and returns one error per
+// invalid output.
+func validate(files []File) []error {
+	var errs []error
+	for _, file := range files {
+		if !validated(file.Name) {
+			continue
+		}
+		if err := yamlutil.Validate(file.Source, file.Content); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validated tells whether the output name is parsed by validate.
+func validated(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range ValidatedExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
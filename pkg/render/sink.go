@@ -0,0 +1,363 @@
+package render
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"yaml-template-cli/pkg/fileutil"
+	"yaml-template-cli/pkg/yamlutil"
+)
+
+// Sink receives the files of a render.
+type Sink interface {
+	Write(files []File) error
+}
+
+// MarkerFile is written in the output directories created by DirSink. Clean
+// only deletes files in a directory holding it, so it never touches a
+// directory the tool did not create.
+const MarkerFile = ".yaml-template-cli"
+
+const markerContent = "# This directory is rendered by yaml-template-cli.\n" +
+	"# Files not produced by the templates are deleted by --clean.\n"
+
+// DirSink writes every file to its path in a directory. Files whose content
+// did not change are not rewritten, so their modification time is kept.
+type DirSink struct {
+	Dir string
+	// Clean removes the files of Dir that the render did not produce. It
+	// requires the MarkerFile in Dir.
+	Clean bool
+	// DryRun writes and removes nothing, it only lists the files Clean
+	// would remove to Out.
+	DryRun bool
+	Out    io.Writer
+	// Atomic prepares the new content of Dir in a temporary sibling
+	// directory, then swaps it in, see swapDir. Dir never holds a partial
+	// render, and if anything fails, Dir is left untouched.
+	Atomic bool
+}
+
+func (s *DirSink) Write(files []File) error {
+	if s.Atomic && !s.DryRun {
+		return s.writeAtomic(files)
+	}
+	owned, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	if s.Clean {
+		if !owned {
+			return fmt.Errorf("refusing to clean %s: it was not created by yaml-template-cli (no %s file)", s.Dir, MarkerFile)
+		}
+		if err := s.clean(files); err != nil {
+			return err
+		}
+	}
+	if s.DryRun {
+		return nil
+	}
+	for _, file := range files {
+		name := filepath.Join(s.Dir, file.Name)
+		if _, err := fileutil.WriteFileIfChanged(name, []byte(file.Content), file.perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAtomic applies Write to a copy of Dir in a temporary sibling directory
+// and swaps the copy in.
+func (s *DirSink) writeAtomic(files []File) (err error) {
+	dir := filepath.Clean(s.Dir)
+	parent, base := filepath.Dir(dir), filepath.Base(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(parent, "."+base+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	mode := os.FileMode(0755)
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil:
+		// Start from the current content, so files not produced by the
+		// render are kept unless Clean is set.
+		mode = info.Mode().Perm()
+		if err := fileutil.CopyDir(dir, tmp); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+
+	staged := *s
+	staged.Dir = tmp
+	staged.Atomic = false
+	if err := staged.Write(files); err != nil {
+		return err
+	}
+	return swapDir(tmp, dir)
+}
+
+// swapDir replaces dir by tmp. On Linux both are exchanged in a single
+// atomic rename, so dir always holds either the previous or the new output.
+// Where the exchange is not supported, the previous dir is moved aside first
+// and put back if tmp can't be moved in, so dir is never lost, but it does
+// not exist between the two renames.
+func swapDir(tmp, dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return os.Rename(tmp, dir)
+	}
+	if err := exchange(tmp, dir); err == nil {
+		return os.RemoveAll(tmp)
+	}
+	old := tmp + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if restoreErr := os.Rename(old, dir); restoreErr != nil {
+			return fmt.Errorf("%v, and the previous output could not be restored from %s: %v", err, old, restoreErr)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// prepare creates Dir with its MarkerFile if it does not exist yet, or is
+// empty, and reports whether Dir holds the MarkerFile.
+func (s *DirSink) prepare() (bool, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(entries) > 0 {
+		_, err := os.Stat(filepath.Join(s.Dir, MarkerFile))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return err == nil, nil
+	}
+	if s.DryRun {
+		return true, nil
+	}
+	return true, fileutil.WriteFile(filepath.Join(s.Dir, MarkerFile), []byte(markerContent), 0644)
+}
+
+// clean removes the files of Dir that are not in files, and the directories
+// left empty.
+func (s *DirSink) clean(files []File) error {
+	keep := map[string]bool{filepath.Join(s.Dir, MarkerFile): true}
+	for _, file := range files {
+		keep[filepath.Join(s.Dir, file.Name)] = true
+	}
+	existing, err := fileutil.ListAllFiles(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range existing {
+		if keep[name] {
+			continue
+		}
+		if s.DryRun {
+			if s.Out != nil {
+				fmt.Fprintf(s.Out, "would remove %s\n", name)
+			}
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		if err := removeEmptyDirs(s.Dir, filepath.Dir(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to root, as long as they are
+// empty.
+func removeEmptyDirs(root, dir string) error {
+	root, dir = filepath.Clean(root), filepath.Clean(dir)
+	for inside(root, dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return err
+		}
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// inside tells whether dir is below root, both being clean paths.
+func inside(root, dir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// StreamSink writes the files as a multi-document YAML stream.
+type StreamSink struct {
+	W io.Writer
+	// Separator is the line written between two documents, "---" when empty.
+	Separator string
+	// SourceHeader adds a "# Source: <template>" comment to every document.
+	SourceHeader bool
+	// SplitDocuments writes every document of a file as a separate document
+	// of the stream.
+	SplitDocuments bool
+}
+
+func (s *StreamSink) Write(files []File) error {
+	stream := yamlutil.NewStreamWriter(s.W)
+	if s.Separator != "" {
+		stream.Separator = s.Separator
+	}
+	stream.SourceHeader = s.SourceHeader
+	stream.SplitDocuments = s.SplitDocuments
+	for _, file := range files {
+		if err := stream.Write(file.Source, file.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// perm returns the permissions to write the file with.
+func (f File) perm() os.FileMode {
+	if f.Mode == 0 {
+		return DefaultFileMode
+	}
+	return f.Mode
+}
+
+// The output formats a render can be written in.
+const (
+	OutputDir    = "dir"
+	OutputStdout = "stdout"
+	OutputTarGz  = "tar.gz"
+	OutputZip    = "zip"
+	OutputFile   = "file"
+)
+
+// OutputFormats lists the supported output formats.
+var OutputFormats = []string{OutputDir, OutputStdout, OutputTarGz, OutputZip, OutputFile}
+
+// archiveModTime is the modification time of every file of the archives, so
+// the same render always produces the same archive. It is the earliest time
+// a zip archive can hold.
+var archiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TarGzSink writes the files to a gzipped tar archive.
+type TarGzSink struct {
+	Path string
+}
+
+func (s *TarGzSink) Write(files []File) error {
+	return writeArchive(s.Path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, file := range files {
+			hdr := &tar.Header{
+				Name:    filepath.ToSlash(file.Name),
+				Mode:    int64(file.perm()),
+				Size:    int64(len(file.Content)),
+				ModTime: archiveModTime,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(tw, file.Content); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// ZipSink writes the files to a zip archive.
+type ZipSink struct {
+	Path string
+}
+
+func (s *ZipSink) Write(files []File) error {
+	return writeArchive(s.Path, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		for _, file := range files {
+			hdr := &zip.FileHeader{
+				Name:     filepath.ToSlash(file.Name),
+				Method:   zip.Deflate,
+				Modified: archiveModTime,
+			}
+			hdr.SetMode(file.perm())
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(fw, file.Content); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+}
+
+// FileSink writes all the files to a single file, as a multi-document YAML
+// stream.
+type FileSink struct {
+	Path string
+	// Stream shapes the content of the file, its W is ignored.
+	Stream StreamSink
+}
+
+func (s *FileSink) Write(files []File) error {
+	return writeArchive(s.Path, func(w io.Writer) error {
+		stream := s.Stream
+		stream.W = w
+		return stream.Write(files)
+	})
+}
+
+// writeArchive creates the file at path and fills it with write. The file is
+// removed if write fails, so a broken archive is never left behind.
+func writeArchive(path string, write func(w io.Writer) error) error {
+	if path == "" {
+		return fmt.Errorf("output path is not specified")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
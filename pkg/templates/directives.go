@@ -0,0 +1,35 @@
+package templates
+
+import (
+	"regexp"
+)
+
+// Directives are settings a templates file gives about its own output, written
+// as template comments so they never show up in the output:
+//
+//	{{/* @mode: 0600 */}}
+const (
+	// DirectiveMode sets the permissions of the output file, in octal.
+	DirectiveMode = "mode"
+	// DirectiveOutput sets the path of the output file, relative to the
+	// output directory. The path is rendered as a template.
+	DirectiveOutput = "output"
+	// DirectiveSkipIfEmpty drops the output file when it renders to nothing
+	// but whitespace.
+	DirectiveSkipIfEmpty = "skip-if-empty"
+	// DirectiveMatrix names a values list, e.g. services, the template is
+	// rendered once per element of.
+	DirectiveMatrix = "matrix"
+)
+
+var directiveRegex = regexp.MustCompile(`\{\{-?\s*/\*\s*@([\w-]+)(?::[ \t]*(.*?))?\s*\*/\s*-?\}\}`)
+
+// ParseDirectives returns the directives found in the templates data, keyed by
+// name. A directive without a value maps to an empty string.
+func ParseDirectives(data []byte) map[string]string {
+	directives := map[string]string{}
+	for _, m := range directiveRegex.FindAllSubmatch(data, -1) {
+		directives[string(m[1])] = string(m[2])
+	}
+	return directives
+}
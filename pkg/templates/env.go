@@ -0,0 +1,44 @@
+package templates
+
+import (
+	"strings"
+)
+
+// EnvSeparator separates the nested keys in the name of an environment
+// variable loaded by ReadEnvValues.
+const EnvSeparator = "__"
+
+// ReadEnvValues loads the environment variables starting with prefix and
+// EnvSeparator as nested values. With the prefix "APP", APP__db__host=x
+// becomes {db: {host: x}}, while APPLICATION=x is not loaded.
+// environ is a list of "key=value" strings, as returned by os.Environ.
+func ReadEnvValues(prefix string, environ []string) Values {
+	vals := Values{}
+	prefix = strings.TrimSuffix(prefix, EnvSeparator) + EnvSeparator
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		var keys []string
+		for _, key := range strings.Split(strings.TrimPrefix(name, prefix), EnvSeparator) {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		table := vals
+		for _, key := range keys[:len(keys)-1] {
+			next, ok := table[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				table[key] = next
+			}
+			table = next
+		}
+		table[keys[len(keys)-1]] = value
+	}
+	return vals
+}
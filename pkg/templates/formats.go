@@ -0,0 +1,233 @@
+package templates
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// The formats values files can be written in.
+const (
+	FormatYAML       = "yaml"
+	FormatJSON       = "json"
+	FormatTOML       = "toml"
+	FormatEnv        = "env"
+	FormatProperties = "properties"
+)
+
+// Formats lists the supported values formats.
+var Formats = []string{FormatYAML, FormatJSON, FormatTOML, FormatEnv, FormatProperties}
+
+// FormatFromFilename picks the values format from the extension of filename.
+// Unknown extensions are read as YAML.
+func FormatFromFilename(filename string) string {
+	base := filepath.Base(filename)
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	case ".env":
+		return FormatEnv
+	case ".properties":
+		return FormatProperties
+	}
+	// Also accept the usual dotenv names, e.g. ".env" or ".env.local".
+	if base == ".env" || strings.HasPrefix(base, ".env.") {
+		return FormatEnv
+	}
+	return FormatYAML
+}
+
+// ParseValues parses data written in the given format. An empty format means
+// YAML.
+func ParseValues(data []byte, format string) (Values, error) {
+	switch format {
+	case "", FormatYAML:
+		return ReadValues(data)
+	case FormatJSON:
+		vals := Values{}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return vals, nil
+		}
+		err := json.Unmarshal(data, &vals)
+		return vals, err
+	case FormatTOML:
+		vals := Values{}
+		_, err := toml.Decode(string(data), &vals)
+		return vals, err
+	case FormatEnv:
+		return parseEnv(data)
+	case FormatProperties:
+		return parseProperties(data)
+	}
+	return nil, errors.Errorf("unknown values format %q, must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// parseEnv parses a dotenv file. Keys are kept flat.
+func parseEnv(data []byte) (Values, error) {
+	vals := Values{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, errors.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		value, err := envValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		vals[key] = value
+	}
+	return vals, scanner.Err()
+}
+
+// envValue unquotes a dotenv value. Double quoted values support escapes,
+// single quoted values are literal and unquoted values end at a " #" comment.
+func envValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", errors.New("unterminated double quoted value")
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", errors.New("unterminated single quoted value")
+		}
+		return value[1:end], nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// parseProperties parses a Java properties file. Dotted keys become nested
+// values, so log.level.root=info sets {log: {level: {root: info}}}.
+func parseProperties(data []byte) (Values, error) {
+	vals := Values{}
+	var logical strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if logical.Len() == 0 && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		// A line ending with an odd number of backslashes continues on the
+		// next line.
+		trailing := len(line) - len(strings.TrimRight(line, `\`))
+		if trailing%2 == 1 {
+			logical.WriteString(line[:len(line)-1])
+			continue
+		}
+		logical.WriteString(line)
+		key, value := splitProperty(logical.String())
+		logical.Reset()
+		if err := setPath(vals, parsePath(key), value); err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+	}
+	if logical.Len() > 0 {
+		key, value := splitProperty(logical.String())
+		if err := setPath(vals, parsePath(key), value); err != nil {
+			return nil, err
+		}
+	}
+	return vals, scanner.Err()
+}
+
+// splitProperty splits a properties line on the first unescaped '=', ':' or
+// whitespace, and unescapes both parts.
+func splitProperty(line string) (string, string) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' || line[i] == '\f' {
+			end = i
+			break
+		}
+	}
+	key, rest := line[:end], strings.TrimLeft(line[end:], " \t\f")
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	return unescapeProperty(key), unescapeProperty(rest)
+}
+
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 < len(s) {
+				if r, err := strconv.ParseUint(s[i+1:i+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+					i += 4
+					continue
+				}
+			}
+			b.WriteByte('u')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// setPath sets the value at the nested path, creating the tables on the way.
+func setPath(vals Values, path []string, value interface{}) error {
+	table := vals
+	for i, key := range path[:len(path)-1] {
+		switch next := table[key].(type) {
+		case nil:
+			m := map[string]interface{}{}
+			table[key] = m
+			table = m
+		case map[string]interface{}:
+			table = next
+		default:
+			return fmt.Errorf("%q is both a value and a table", joinPath(path[:i+1]...))
+		}
+	}
+	key := path[len(path)-1]
+	if _, ok := table[key].(map[string]interface{}); ok {
+		return fmt.Errorf("%q is both a value and a table", joinPath(path...))
+	}
+	table[key] = value
+	return nil
+}
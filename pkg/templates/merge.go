@@ -0,0 +1,201 @@
+package templates
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PatchKey is the key of the directive a values file can put in a table to
+// choose how that table is merged:
+//
+//	$patch: replace   the table replaces the previous one instead of being merged
+//	$patch: delete    the key is removed from the previous values
+//
+// A list holding a {$patch: replace} item replaces the previous list whatever
+// the merge strategy. With MergeListsByKey, an item of the list can also hold
+// a $patch directive: replace swaps it for the previous item with the same
+// key instead of merging them, and delete removes that previous item.
+const PatchKey = "$patch"
+
+const (
+	patchReplace = "replace"
+	patchDelete  = "delete"
+)
+
+// MergeStrategy selects how two lists are merged.
+type MergeStrategy string
+
+const (
+	// MergeReplace makes the later list replace the earlier one.
+	MergeReplace MergeStrategy = "replace"
+	// MergeAppendLists appends the items of the later list to the earlier one.
+	MergeAppendLists MergeStrategy = "append-lists"
+	// MergeListsByKey merges the tables of both lists that have the same
+	// value for MergeOptions.ListKey and appends the other items.
+	MergeListsByKey MergeStrategy = "merge-lists-by-key"
+)
+
+// MergeStrategies lists the supported merge strategies.
+var MergeStrategies = []MergeStrategy{MergeReplace, MergeAppendLists, MergeListsByKey}
+
+// DefaultListKey identifies the items of two lists merged by MergeListsByKey.
+const DefaultListKey = "name"
+
+// MergeOptions control MergeValues.
+type MergeOptions struct {
+	Strategy MergeStrategy
+	// ListKey is the key identifying list items for MergeListsByKey.
+	ListKey string
+}
+
+// ParseMergeStrategy checks that s names a supported merge strategy.
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	for _, strategy := range MergeStrategies {
+		if string(strategy) == s {
+			return strategy, nil
+		}
+	}
+	names := make([]string, len(MergeStrategies))
+	for i, strategy := range MergeStrategies {
+		names[i] = string(strategy)
+	}
+	return "", fmt.Errorf("unknown merge strategy %q, must be one of %s", s, strings.Join(names, ", "))
+}
+
+// MergeValues merges src over dst and returns the result, dst is modified in
+// place. Tables are merged recursively, a null in src removes the key from
+// dst, and any other value of src, tables included, replaces the one of dst.
+// Lists are merged according to opts.Strategy, and $patch directives override
+// this behavior for their subtree.
+func MergeValues(dst, src map[string]interface{}, opts MergeOptions) map[string]interface{} {
+	if dst == nil {
+		dst = map[string]interface{}{}
+	}
+	for key, srcVal := range src {
+		if key == PatchKey {
+			continue
+		}
+		if srcVal == nil {
+			delete(dst, key)
+			continue
+		}
+		if srcMap, ok := asMap(srcVal); ok {
+			switch srcMap[PatchKey] {
+			case patchDelete:
+				delete(dst, key)
+				continue
+			case patchReplace:
+				dst[key] = clean(srcMap)
+				continue
+			}
+			if dstMap, ok := asMap(dst[key]); ok {
+				dst[key] = MergeValues(dstMap, srcMap, opts)
+			} else {
+				dst[key] = clean(srcMap)
+			}
+			continue
+		}
+		if srcList, ok := srcVal.([]interface{}); ok {
+			dstList, _ := dst[key].([]interface{})
+			dst[key] = mergeLists(dstList, srcList, opts)
+			continue
+		}
+		dst[key] = srcVal
+	}
+	return dst
+}
+
+func mergeLists(dst, src []interface{}, opts MergeOptions) []interface{} {
+	replace := false
+	items := make([]interface{}, 0, len(src))
+	for _, item := range src {
+		if m, ok := asMap(item); ok && len(m) == 1 && m[PatchKey] == patchReplace {
+			replace = true
+			continue
+		}
+		items = append(items, clean(item))
+	}
+	if replace || dst == nil {
+		return items
+	}
+	switch opts.Strategy {
+	case MergeAppendLists:
+		return append(append([]interface{}{}, dst...), items...)
+	case MergeListsByKey:
+		listKey := opts.ListKey
+		if listKey == "" {
+			listKey = DefaultListKey
+		}
+		merged := append([]interface{}{}, dst...)
+	next:
+		for _, item := range src {
+			srcMap, ok := asMap(item)
+			if !ok || srcMap[listKey] == nil {
+				merged = append(merged, clean(item))
+				continue
+			}
+			for i, existing := range merged {
+				if dstMap, ok := asMap(existing); ok && reflect.DeepEqual(dstMap[listKey], srcMap[listKey]) {
+					switch srcMap[PatchKey] {
+					case patchDelete:
+						merged = append(merged[:i], merged[i+1:]...)
+					case patchReplace:
+						merged[i] = clean(srcMap)
+					default:
+						merged[i] = MergeValues(copyMap(dstMap), srcMap, opts)
+					}
+					continue next
+				}
+			}
+			if srcMap[PatchKey] != patchDelete {
+				merged = append(merged, clean(srcMap))
+			}
+		}
+		return merged
+	}
+	return items
+}
+
+// clean drops the $patch directives and the null values of tables, which
+// only make sense while merging.
+func clean(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			if key == PatchKey || val == nil {
+				continue
+			}
+			out[key] = clean(val)
+		}
+		return out
+	case Values:
+		return clean(map[string]interface{}(v))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = clean(item)
+		}
+		return out
+	}
+	return v
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for key, val := range m {
+		out[key] = val
+	}
+	return out
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Values:
+		return v, true
+	}
+	return nil, false
+}
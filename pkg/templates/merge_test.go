@@ -0,0 +1,180 @@
+package templates
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy MergeStrategy
+		dst      string
+		src      string
+		want     string
+	}{
+		{
+			name: "nested tables",
+			dst:  "a: {b: 1, c: 1}",
+			src:  "a: {c: 2, d: 2}",
+			want: "a: {b: 1, c: 2, d: 2}",
+		},
+		{
+			name: "table over scalar",
+			dst:  "a: 1",
+			src:  "a: {b: 2}",
+			want: "a: {b: 2}",
+		},
+		{
+			name: "scalar over table",
+			dst:  "a: {b: 1}",
+			src:  "a: 2",
+			want: "a: 2",
+		},
+		{
+			name: "null deletes",
+			dst:  "a: {b: 1, c: 1}",
+			src:  "a: {b: null}",
+			want: "a: {c: 1}",
+		},
+		{
+			name: "null deletes a table",
+			dst:  "a: {b: 1}",
+			src:  "a: null",
+			want: "{}",
+		},
+		{
+			name: "nulls of a new table are dropped",
+			dst:  "{}",
+			src:  "a: {b: null, c: 1}",
+			want: "a: {c: 1}",
+		},
+		{
+			name: "patch replace",
+			dst:  "a: {b: 1, c: 1}",
+			src:  "a: {$patch: replace, c: 2}",
+			want: "a: {c: 2}",
+		},
+		{
+			name: "patch delete",
+			dst:  "a: {b: 1}\nd: 1",
+			src:  "a: {$patch: delete}",
+			want: "d: 1",
+		},
+		{
+			name: "patch in a new table",
+			dst:  "{}",
+			src:  "a: {b: {$patch: replace, c: 1}}",
+			want: "a: {b: {c: 1}}",
+		},
+		{
+			name:     "replace lists",
+			strategy: MergeReplace,
+			dst:      "l: [1, 2]",
+			src:      "l: [3]",
+			want:     "l: [3]",
+		},
+		{
+			name:     "append lists",
+			strategy: MergeAppendLists,
+			dst:      "l: [1, 2]",
+			src:      "l: [3]",
+			want:     "l: [1, 2, 3]",
+		},
+		{
+			name:     "append to a missing list",
+			strategy: MergeAppendLists,
+			dst:      "{}",
+			src:      "l: [3]",
+			want:     "l: [3]",
+		},
+		{
+			name:     "replace marker with append lists",
+			strategy: MergeAppendLists,
+			dst:      "l: [1, 2]",
+			src:      "l: [{$patch: replace}, 3]",
+			want:     "l: [3]",
+		},
+		{
+			name:     "replace marker with merge lists by key",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, v: 1}]",
+			src:      "l: [{$patch: replace}, {name: a, w: 2}]",
+			want:     "l: [{name: a, w: 2}]",
+		},
+		{
+			name:     "merge lists by key",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, v: 1}, {name: b, v: 1}]",
+			src:      "l: [{name: b, v: 2, w: 2}, {name: c, v: 3}]",
+			want:     "l: [{name: a, v: 1}, {name: b, v: 2, w: 2}, {name: c, v: 3}]",
+		},
+		{
+			name:     "merge lists by key appends items without key",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a}, 1]",
+			src:      "l: [{v: 1}, 2]",
+			want:     "l: [{name: a}, 1, {v: 1}, 2]",
+		},
+		{
+			name:     "merge lists by key merges tables recursively",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, env: {x: 1, y: 1}}]",
+			src:      "l: [{name: a, env: {y: null, z: 2}}]",
+			want:     "l: [{name: a, env: {x: 1, z: 2}}]",
+		},
+		{
+			name:     "patch replace on a list item",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, v: 1}, {name: b, v: 1}]",
+			src:      "l: [{name: a, $patch: replace, w: 2}]",
+			want:     "l: [{name: a, w: 2}, {name: b, v: 1}]",
+		},
+		{
+			name:     "patch delete on a list item",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, v: 1}, {name: b, v: 1}]",
+			src:      "l: [{name: a, $patch: delete}]",
+			want:     "l: [{name: b, v: 1}]",
+		},
+		{
+			name:     "patch delete on a new list item",
+			strategy: MergeListsByKey,
+			dst:      "l: [{name: a, v: 1}]",
+			src:      "l: [{name: b, $patch: delete}]",
+			want:     "l: [{name: a, v: 1}]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst, src, want map[string]interface{}
+			for _, v := range []struct {
+				text string
+				out  *map[string]interface{}
+			}{{tt.dst, &dst}, {tt.src, &src}, {tt.want, &want}} {
+				if err := yaml.Unmarshal([]byte(v.text), v.out); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := MergeValues(dst, src, MergeOptions{Strategy: tt.strategy})
+			if !reflect.DeepEqual(got, want) {
+				g, _ := yaml.Marshal(got)
+				w, _ := yaml.Marshal(want)
+				t.Errorf("got:\n%s\nwant:\n%s", g, w)
+			}
+		})
+	}
+}
+
+func TestParseMergeStrategy(t *testing.T) {
+	for _, strategy := range MergeStrategies {
+		if got, err := ParseMergeStrategy(string(strategy)); err != nil || got != strategy {
+			t.Errorf("ParseMergeStrategy(%q) = %q, %v", strategy, got, err)
+		}
+	}
+	if _, err := ParseMergeStrategy("deep"); err == nil {
+		t.Error("got no error for an unknown strategy")
+	}
+}
@@ -0,0 +1,96 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// SchemaFileName is the name of the JSON Schema file looked up in the input
+// directory when no schema is given explicitly.
+const SchemaFileName = "values.schema.json"
+
+// SchemaViolation is a single place where the values don't match the schema.
+type SchemaViolation struct {
+	// Path is the JSON pointer of the offending value, e.g. "/db/port".
+	Path    string
+	Message string
+}
+
+func (v SchemaViolation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "(root)"
+	}
+	return fmt.Sprintf("%s: %s", path, v.Message)
+}
+
+// ErrSchemaValidation lists every violation found by ValidateAgainstSchema.
+type ErrSchemaValidation struct {
+	Violations []SchemaViolation
+}
+
+func (e ErrSchemaValidation) Error() string {
+	var b strings.Builder
+	b.WriteString("values don't meet the specifications of the schema:")
+	for _, v := range e.Violations {
+		b.WriteString("\n- " + v.String())
+	}
+	return b.String()
+}
+
+// ValidateAgainstSchema checks that values match the given JSON Schema. Every
+// violation is reported, not just the first one.
+func ValidateAgainstSchema(values Values, schemaJSON []byte) error {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(SchemaFileName, bytes.NewReader(schemaJSON)); err != nil {
+		return errors.Wrap(err, "invalid values schema")
+	}
+	schema, err := compiler.Compile(SchemaFileName)
+	if err != nil {
+		return errors.Wrap(err, "invalid values schema")
+	}
+
+	// The validator only understands the types produced by encoding/json,
+	// so round-trip the values (which may hold e.g. int64 from --set).
+	data, err := json.Marshal(values.AsMap())
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	err = schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+	result := ErrSchemaValidation{}
+	collectViolations(verr, &result.Violations)
+	sort.SliceStable(result.Violations, func(i, j int) bool {
+		return result.Violations[i].Path < result.Violations[j].Path
+	})
+	return result
+}
+
+// collectViolations appends the leaves of the error tree, which carry the
+// actual reasons, to violations.
+func collectViolations(err *jsonschema.ValidationError, violations *[]SchemaViolation) {
+	if len(err.Causes) == 0 {
+		*violations = append(*violations, SchemaViolation{Path: err.InstanceLocation, Message: err.Message})
+		return
+	}
+	for _, cause := range err.Causes {
+		collectViolations(cause, violations)
+	}
+}
@@ -1,11 +1,26 @@
 package templates
 
+import "os"
+
 type File struct {
 	Name string `json:"name"`
 	Data []byte `json:"data"`
+	// Mode is the permissions of the templates file, zero when unknown.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Matrix renders the templates once per element of Items instead of once.
+	// MatrixPath is the values path Items come from.
+	Matrix     bool          `json:"matrix,omitempty"`
+	MatrixPath string        `json:"matrixPath,omitempty"`
+	Items      []interface{} `json:"items,omitempty"`
+	// Library templates only provide named templates to the others and are
+	// not rendered. Local definitions take precedence over theirs.
+	Library bool `json:"library,omitempty"`
 }
 
 type Template struct {
 	Templates []File `json:"templates"`
 	Values    Values `json:"values"`
+	// Files are the other files of the input directory, by slash separated
+	// path, that the templates can read.
+	Files map[string][]byte `json:"files,omitempty"`
 }
@@ -1,8 +1,6 @@
 package templates
 
 import (
-	"fmt"
-	"github.com/imdario/mergo"
 	"io"
 	"os"
 	"strings"
@@ -49,11 +47,15 @@ func (v Values) Encode(w io.Writer) error {
 	return err
 }
 
+// OverrideValues merges overrides over v, replacing lists. A null in
+// overrides removes the key from v.
 func (v Values) OverrideValues(overrides Values) {
-	err := mergo.Merge(&v, overrides, mergo.WithOverride)
-	if err != nil {
-		fmt.Println(err)
-	}
+	v.MergeValues(overrides, MergeOptions{Strategy: MergeReplace})
+}
+
+// MergeValues merges overrides over v with the given options, see MergeValues.
+func (v Values) MergeValues(overrides Values, opts MergeOptions) {
+	MergeValues(v, overrides, opts)
 }
 
 func tableLookup(v Values, simple string) (Values, error) {
@@ -88,7 +90,32 @@ func ReadValuesFile(filename string) (Values, error) {
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
-	return ReadValues(data)
+	return ParseValues(data, FormatFromFilename(filename))
+}
+
+// DeepCopy returns a copy of the values sharing no map or list with them.
+func (v Values) DeepCopy() Values {
+	return deepCopy(map[string]interface{}(v)).(map[string]interface{})
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			out[key] = deepCopy(val)
+		}
+		return out
+	case Values:
+		return Values(deepCopy(map[string]interface{}(v)).(map[string]interface{}))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = deepCopy(item)
+		}
+		return out
+	}
+	return v
 }
 
 func istable(v interface{}) bool {
@@ -128,3 +155,40 @@ func (v Values) pathValue(path []string) (interface{}, error) {
 func parsePath(key string) []string { return strings.Split(key, ".") }
 
 func joinPath(path ...string) string { return strings.Join(path, ".") }
+
+var keyEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`)
+
+// JoinKeys joins the keys of a values path with dots, e.g. "db.host". The
+// dots and backslashes of the keys are escaped with a backslash, so a key
+// holding dots, e.g. "app.kubernetes.io/name", is still a single key of the
+// path.
+func JoinKeys(keys ...string) string {
+	escaped := make([]string, len(keys))
+	for i, key := range keys {
+		escaped[i] = keyEscaper.Replace(key)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// SplitKeys splits a values path joined by JoinKeys into its keys. The empty
+// path has no keys.
+func SplitKeys(path string) []string {
+	if path == "" {
+		return nil
+	}
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			key.WriteByte(path[i])
+		case c == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(c)
+		}
+	}
+	return append(keys, key.String())
+}
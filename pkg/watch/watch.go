@@ -0,0 +1,124 @@
+package watch
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultInterval is how often the watched paths are polled.
+	DefaultInterval = 500 * time.Millisecond
+	// DefaultDebounce is how long the watched paths must stay unchanged
+	// before a change is reported, so rapid saves trigger a single reload.
+	DefaultDebounce = 300 * time.Millisecond
+)
+
+// Watcher polls files and directories and reports when any of them changes.
+// Polling keeps it portable and free of platform specific notification APIs.
+type Watcher struct {
+	// Paths are the files and directories to watch. Directories are watched
+	// recursively.
+	Paths []string
+	// Exclude are directories and files that are never watched, e.g. an
+	// output directory or a cache file located inside a watched input
+	// directory.
+	Exclude  []string
+	Interval time.Duration
+	Debounce time.Duration
+}
+
+// New returns a Watcher for paths with the default interval and debounce.
+func New(paths []string, exclude ...string) *Watcher {
+	return &Watcher{
+		Paths:    paths,
+		Exclude:  exclude,
+		Interval: DefaultInterval,
+		Debounce: DefaultDebounce,
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    fs.FileMode
+}
+
+type snapshot map[string]fileState
+
+func (s snapshot) equal(o snapshot) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for name, state := range s {
+		if other, ok := o[name]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}
+
+// Run calls onChange every time the watched paths change, until stop is
+// closed.
+func (w *Watcher) Run(stop <-chan struct{}, onChange func()) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	last := w.snapshot()
+	var pending snapshot
+	var changedAt time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			current := w.snapshot()
+			if !current.equal(last) {
+				// Still changing, wait for the writes to settle.
+				last = current
+				pending = current
+				changedAt = now
+				continue
+			}
+			if pending != nil && now.Sub(changedAt) >= w.Debounce {
+				pending = nil
+				onChange()
+			}
+		}
+	}
+}
+
+func (w *Watcher) snapshot() snapshot {
+	exclude := make(map[string]bool, len(w.Exclude))
+	for _, name := range w.Exclude {
+		if abs, err := filepath.Abs(name); err == nil {
+			exclude[abs] = true
+		}
+	}
+	s := snapshot{}
+	for _, path := range w.Paths {
+		// Errors are ignored: a file that is missing or unreadable now may
+		// be back by the next poll, and its absence is a change itself.
+		_ = filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if abs, err := filepath.Abs(name); err == nil && exclude[abs] && name != path {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if abs, err := filepath.Abs(name); err == nil && exclude[abs] {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			s[name] = fileState{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+			return nil
+		})
+	}
+	return s
+}
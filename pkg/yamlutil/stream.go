@@ -0,0 +1,72 @@
+package yamlutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultSeparator is the line written between two documents of a stream.
+const DefaultSeparator = "---"
+
+// StreamWriter writes rendered templates as a multi-document YAML stream that
+// can be read by `kubectl apply -f -` and other YAML stream readers.
+type StreamWriter struct {
+	// Separator is the line written between two documents.
+	Separator string
+	// SourceHeader adds a "# Source: <template>" comment to every document.
+	SourceHeader bool
+	// SplitDocuments writes every document of a template as a separate
+	// document of the stream, each with its own source header.
+	SplitDocuments bool
+
+	w     io.Writer
+	count int
+}
+
+// NewStreamWriter returns a StreamWriter writing to w.
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{
+		Separator:    DefaultSeparator,
+		SourceHeader: true,
+		w:            w,
+	}
+}
+
+// Write adds the output of the source templates to the stream. Documents that
+// hold nothing but blanks and comments are dropped.
+func (s *StreamWriter) Write(source, content string) error {
+	if !s.SplitDocuments {
+		return s.writeDocument(source, content)
+	}
+	for _, doc := range SplitDocuments(content) {
+		if err := s.writeDocument(source, doc.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StreamWriter) writeDocument(source, content string) error {
+	if IsEmpty(content) {
+		return nil
+	}
+	var b strings.Builder
+	if s.count > 0 {
+		b.WriteString(s.Separator + "\n")
+	}
+	if s.SourceHeader {
+		fmt.Fprintf(&b, "# Source: %s\n", source)
+	}
+	b.WriteString(strings.Trim(content, "\n") + "\n")
+	if _, err := io.WriteString(s.w, b.String()); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// Count returns the number of documents written so far.
+func (s *StreamWriter) Count() int {
+	return s.count
+}
@@ -0,0 +1,213 @@
+package yamlutil
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "sigs.k8s.io/yaml/goyaml.v3"
+
+	"yaml-template-cli/pkg/templates"
+)
+
+// snippetLines is the number of lines shown before and after the failing line.
+const snippetLines = 2
+
+var separatorRegex = regexp.MustCompile(`^---(\s.*)?$`)
+
+var lineRegex = regexp.MustCompile(`^yaml: line (\d+)(?:, column (\d+))?: (.*)$`)
+
+var typeErrorRegex = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// messageLineRegex matches the lines the parser mentions in its messages,
+// e.g. the first definition of a duplicated key.
+var messageLineRegex = regexp.MustCompile(`\bline (\d+)`)
+
+// parserProblems are the messages of errors raised by the YAML parser, as
+// opposed to its scanner. The parser reports their lines counted from 0.
+var parserProblems = []string{
+	"did not find expected",
+	"found undefined tag handle",
+	"found duplicate %",
+	"found incompatible YAML document",
+	"block sequence entries are not allowed",
+}
+
+// Document is a single document of a YAML stream.
+type Document struct {
+	// Content is the text of the document, without its separator line.
+	Content string
+	// Line is the line of the stream the document starts at, counted from 1.
+	Line int
+}
+
+// SplitDocuments splits a YAML stream on its '---' separator lines.
+func SplitDocuments(s string) []Document {
+	var docs []Document
+	var buf strings.Builder
+	start := 1
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if separatorRegex.MatchString(strings.TrimRight(line, "\r\n")) {
+			docs = append(docs, Document{Content: buf.String(), Line: start})
+			buf.Reset()
+			start = i + 2
+			continue
+		}
+		buf.WriteString(line)
+	}
+	return append(docs, Document{Content: buf.String(), Line: start})
+}
+
+// IsEmpty reports whether a document holds nothing but blanks and comments.
+func IsEmpty(s string) bool {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// Error describes a rendered output that is not valid YAML.
+type Error struct {
+	// Template is the name of the templates that produced the output.
+	Template string
+	// Line and Column locate the problem in the rendered output, counted from 1.
+	Line   int
+	Column int
+	// Message is the error reported by the YAML parser.
+	Message string
+	// Snippet shows the output lines around the problem.
+	Snippet string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid YAML in output of (%s) at line %d, column %d: %s\n%s", e.Template, e.Line, e.Column, e.Message, e.Snippet)
+}
+
+// Validate parses every document of content and returns an *Error for the
+// first one that is not valid YAML.
+func Validate(name, content string) error {
+	for _, doc := range SplitDocuments(content) {
+		var out interface{}
+		err := yaml.Unmarshal([]byte(doc.Content), &out)
+		if err == nil {
+			continue
+		}
+		line, column, msg := 1, 0, err.Error()
+		if m := lineRegex.FindStringSubmatch(msg); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			column, _ = strconv.Atoi(m[2])
+			msg = m[3]
+			if isParserProblem(msg) {
+				line++
+			}
+		} else if terr, ok := err.(*yaml.TypeError); ok && len(terr.Errors) > 0 {
+			msg = terr.Errors[0]
+			if m := typeErrorRegex.FindStringSubmatch(msg); m != nil {
+				line, _ = strconv.Atoi(m[1])
+				msg = m[2]
+			}
+		} else {
+			msg = strings.TrimPrefix(msg, "yaml: ")
+		}
+		line += doc.Line - 1
+		msg = shiftLines(msg, doc.Line-1)
+		lines := strings.Split(content, "\n")
+		if line < 1 {
+			line = 1
+		}
+		if line > len(lines) {
+			line = len(lines)
+		}
+		if column == 0 {
+			// The parser only reports lines, so point at the first
+			// non-blank character of the failing line.
+			text := lines[line-1]
+			column = len(text) - len(strings.TrimLeft(text, " \t")) + 1
+		}
+		return &Error{
+			Template: name,
+			Line:     line,
+			Column:   column,
+			Message:  msg,
+			Snippet:  snippet(lines, line),
+		}
+	}
+	return nil
+}
+
+// shiftLines adds offset to the lines mentioned in msg, so that they are
+// counted from the start of the output instead of the document.
+func shiftLines(msg string, offset int) string {
+	if offset == 0 {
+		return msg
+	}
+	return messageLineRegex.ReplaceAllStringFunc(msg, func(s string) string {
+		n, _ := strconv.Atoi(messageLineRegex.FindStringSubmatch(s)[1])
+		return "line " + strconv.Itoa(n+offset)
+	})
+}
+
+func isParserProblem(msg string) bool {
+	for _, p := range parserProblems {
+		if strings.HasPrefix(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// snippet returns the lines around line, marking line itself.
+func snippet(lines []string, line int) string {
+	from, to := line-snippetLines, line+snippetLines
+	if from < 1 {
+		from = 1
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+	width := len(strconv.Itoa(to))
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %*d | %s\n", marker, width, i, lines[i-1])
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// KeyLines returns the line, counted from 1, of every key of the mappings of
+// a YAML (or JSON) document, keyed by path joined by templates.JoinKeys, e.g.
+// "db.host". Keys inside lists are not listed.
+func KeyLines(data []byte) (map[string]int, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	lines := map[string]int{}
+	if len(doc.Content) > 0 {
+		keyLines(doc.Content[0], "", lines)
+	}
+	return lines, nil
+}
+
+func keyLines(node *yaml.Node, prefix string, lines map[string]int) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := templates.JoinKeys(key.Value)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		lines[path] = key.Line
+		keyLines(value, path, lines)
+	}
+}